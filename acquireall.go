@@ -0,0 +1,57 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// AcquireAll acquires every lock with the given ttl, or none of them. Locks are
+// acquired in order of bucket and object name, regardless of the order given,
+// so that two callers requesting overlapping sets cannot deadlock. If any lock
+// cannot be acquired, the locks already acquired by this call are released
+// before returning, and the error names the object that failed. If the failure
+// was because that lock is held, the error wraps a [*LockHeldError].
+func AcquireAll(ctx context.Context, locks []*Lock, ttl time.Duration) error {
+	sorted := make([]*Lock, len(locks))
+	copy(sorted, locks)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].bucket != sorted[j].bucket {
+			return sorted[i].bucket < sorted[j].bucket
+		}
+		return sorted[i].object < sorted[j].object
+	})
+
+	for i, l := range sorted {
+		if err := l.Acquire(ctx, ttl); err != nil {
+			err = fmt.Errorf("failed to acquire gs://%s/%s: %w", l.bucketName(), l.objectName(), err)
+
+			// Roll back in reverse order. The context may be cancelled, so detach
+			// from it.
+			releaseCtx := context.WithoutCancel(ctx)
+			for j := i - 1; j >= 0; j-- {
+				if rerr := sorted[j].Release(releaseCtx); rerr != nil {
+					err = errors.Join(err, rerr)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestAcquireAll(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	base := newTestLock(t, gcsServer)
+
+	a, b, c := base.withObject("a"), base.withObject("b"), base.withObject("c")
+	if err := AcquireAll(ctx, []*Lock{c, a, b}, ttl); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []*Lock{a, b, c} {
+		if generation, _ := l.LastGeneration(); generation == 0 {
+			t.Errorf("expected %q to be acquired", l.object)
+		}
+	}
+
+	// Another caller contends on "b", so "a" must be rolled back and "c" must
+	// never be acquired.
+	if err := b.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := base.withObject("b").Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	a2, b2, d2 := base.withObject("a"), base.withObject("b"), base.withObject("d")
+	err := AcquireAll(ctx, []*Lock{d2, b2, a2}, ttl)
+	checkErr(t, err, "failed to acquire gs://my-bucket/b")
+
+	var lockErr *LockHeldError
+	if !errors.As(err, &lockErr) {
+		t.Errorf("expected %v to be a LockHeldError", err)
+	}
+
+	for _, object := range []string{"a", "d"} {
+		if _, err := gcsServer.Client().Bucket("my-bucket").Object(object).Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+			t.Errorf("expected %q to not exist, got %v", object, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AcquireWithAutoRenew acquires the lock and then renews it in the background
+// every ttl/2 until release is called or the context is cancelled. This is
+// intended for processes that hold the lock for their entire lifetime, such as
+// an elected leader.
+//
+// Each renewal is conditional on the generation of our last write. If another
+// process has written or deleted the lock object in the meantime, the renewal
+// fails with a precondition error, and a [*NotLockOwnerError] is sent on errc
+// immediately rather than retried. If a renewal fails for any other reason, the
+// error is also sent on errc. Either way, renewals stop and callers should treat
+// any error on errc as a loss of the lock. At most one error is sent, and the
+// channel is closed when the background renewer stops.
+//
+// The returned release function stops renewals and makes a best-effort attempt
+// to release the lock. It is safe to call more than once. Cancelling the
+// context stops renewals, but does not release the lock; it will be held until
+// the ttl expires.
+func (l *Lock) AcquireWithAutoRenew(ctx context.Context, ttl time.Duration) (release func(), errc <-chan error, err error) {
+	ctx = l.resolveContext(ctx)
+
+	interval := ttl / 2
+	if interval <= 0 {
+		return nil, nil, l.acquireError(fmt.Errorf("ttl %s is too short to renew", ttl))
+	}
+
+	if err := l.Acquire(ctx, ttl); err != nil {
+		return nil, nil, err
+	}
+
+	renewCtx, cancel := context.WithCancel(ctx)
+	errCh := make(chan error, 1)
+	doneCh := make(chan struct{})
+
+	go func() {
+		defer close(doneCh)
+		defer close(errCh)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := l.Renew(renewCtx, ttl); err != nil {
+				// Do not report errors caused by stopping the renewer.
+				if renewCtx.Err() != nil {
+					return
+				}
+
+				// The lease is lost or its state is unknown. Retrying could extend a
+				// lock that another process now holds, so report and stop.
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			cancel()
+			<-doneCh
+
+			// Release is best-effort. The parent context may already be cancelled,
+			// so detach from it.
+			_ = l.Release(context.WithoutCancel(ctx))
+		})
+	}
+
+	return release, errCh, nil
+}
@@ -23,17 +23,30 @@
 package gcslock
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2/callctx"
 	"github.com/sethvargo/go-retry"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -43,12 +56,47 @@ const (
 	// defaultCacheControl is the default value for the Cache-Control header.
 	defaultCacheControl = "private, no-cache, no-store, no-transform, max-age=0"
 
+	// invalidReason is the reason the JSON API gives for requests it rejects
+	// as invalid, including uploads whose checksum does not match and writes
+	// that set an object ACL on a bucket with uniform bucket-level access.
+	invalidReason = "invalid"
+
+	// alreadyOwnBucketReason is the reason the JSON API gives when creating a
+	// bucket that the caller already owns.
+	alreadyOwnBucketReason = "youAlreadyOwnThisBucket"
+
+	// defaultRetryJitterPercent is the default jitter applied to the retry
+	// policy, so that many processes starting at once do not retry in lockstep.
+	defaultRetryJitterPercent = 25
+
 	// defaultChunkSize is the default chunking size. Files are metadata-only, so
 	// we intentionally make this very small.
 	defaultChunkSize = 1024
 
+	// defaultMaxRetries is the maximum number of retries for failed API calls.
+	defaultMaxRetries = 5
+
+	// requestReasonHeader is the header recorded in Cloud Audit Logs as the
+	// reason for a request.
+	requestReasonHeader = "x-goog-request-reason"
+
+	// idempotencyTokenHeader is the header Google Cloud Storage uses to
+	// recognize retries of the same request.
+	idempotencyTokenHeader = "x-goog-gcs-idempotency-token"
+
 	// notBeforeKey is the metadata key where the not-before timestamp is stored.
 	notBeforeKey = "nbf"
+
+	// ownerKey is the metadata key where the owner of the lease is stored.
+	ownerKey = "owner"
+
+	// tokenKey is the metadata key where the random token identifying a single
+	// acquisition is stored.
+	tokenKey = "token"
+
+	// acquiredAtKey is the metadata key where the Unix time at which the lease
+	// was acquired is stored, if [WithTrackAcquiredAt] is set.
+	acquiredAtKey = "acquired_at"
 )
 
 // Lockable is the interface that defines how to manage a lock with Google Cloud
@@ -58,11 +106,50 @@ type Lockable interface {
 	Close(ctx context.Context) error
 }
 
+// ErrLockGone is returned when the lock object no longer exists.
+var ErrLockGone = errors.New("lock object does not exist")
+
+// ErrDraining is returned when acquiring or renewing a lock after [Lock.Drain]
+// has been called.
+var ErrDraining = errors.New("lock is draining")
+
+// ErrTooSoon is returned when acquiring a lock again within the interval
+// configured with [WithMinAcquireInterval] of the last successful acquisition.
+var ErrTooSoon = errors.New("lock acquired too recently")
+
+// ErrLockHeld is a sentinel that matches any [*LockHeldError] with
+// [errors.Is]. Use it when the expiration time is not needed.
+var ErrLockHeld = errors.New("lock held")
+
+// IsTimeout returns true if the error is because a deadline was exceeded, such
+// as the deadline on the context given to [Lock.Acquire] expiring while
+// retrying, or an operation timeout from [WithOperationTimeout]. This
+// distinguishes "timed out waiting" from [ErrLockHeld]. The underlying
+// [context.DeadlineExceeded] is also preserved for [errors.Is].
+func IsTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if status.Code(err) == codes.DeadlineExceeded {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 var _ error = (*LockHeldError)(nil)
 
 // LockHeldError is a specific error returned when a lock is alread held.
 type LockHeldError struct {
-	nbf int64
+	nbf   int64
+	owner string
+
+	// info is the state of the lock object, if it was read.
+	info *LockInfo
 }
 
 // NewLockHeldError creates an instance of a LockHeldError.
@@ -72,6 +159,16 @@ func NewLockHeldError(nbf int64) *LockHeldError {
 	}
 }
 
+// newLockHeldErrorFromInfo creates a LockHeldError for the lease described by
+// info, including its owner.
+func newLockHeldErrorFromInfo(info *LockInfo) *LockHeldError {
+	return &LockHeldError{
+		nbf:   info.NotBefore.Unix(),
+		owner: info.Owner,
+		info:  info.clone(),
+	}
+}
+
 // Error implements the error interface.
 func (e *LockHeldError) Error() string {
 	return "lock held until " + e.NotBefore().Format(time.RFC3339)
@@ -82,12 +179,289 @@ func (e *LockHeldError) NotBefore() time.Time {
 	return time.Unix(e.nbf, 0).UTC()
 }
 
-// Is implements the error comparison interface.
+// Owner returns the owner of the lease that holds the lock, as set with
+// [WithOwner]. It is empty if no owner was recorded.
+func (e *LockHeldError) Owner() string {
+	return e.owner
+}
+
+// MarshalJSON implements [json.Marshaler], so that the error can be logged as
+// structured data.
+func (e *LockHeldError) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(&struct {
+		Error     string `json:"error"`
+		NotBefore string `json:"not_before"`
+		Owner     string `json:"owner"`
+	}{
+		Error:     "lock_held",
+		NotBefore: e.NotBefore().Format(time.RFC3339),
+		Owner:     e.owner,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal error: %w", err)
+	}
+	return b, nil
+}
+
+// Is implements the error comparison interface. It also matches
+// [ErrLockHeld].
 func (e *LockHeldError) Is(err error) bool {
+	if err == ErrLockHeld {
+		return true
+	}
+
 	var terr *LockHeldError
 	return errors.As(err, &terr)
 }
 
+var _ error = (*NotLockOwnerError)(nil)
+
+// NotLockOwnerError is returned when an operation requires that this process
+// holds the lock, but it does not. This happens when the lock was never
+// acquired, or when another process acquired or deleted it after our lease
+// expired.
+type NotLockOwnerError struct {
+	bucket string
+	object string
+}
+
+// NewNotLockOwnerError creates an instance of a NotLockOwnerError.
+func NewNotLockOwnerError(bucket, object string) *NotLockOwnerError {
+	return &NotLockOwnerError{
+		bucket: bucket,
+		object: object,
+	}
+}
+
+// Error implements the error interface.
+func (e *NotLockOwnerError) Error() string {
+	return fmt.Sprintf("lock gs://%s/%s is not held by this process", e.bucket, e.object)
+}
+
+// Is implements the error comparison interface.
+func (e *NotLockOwnerError) Is(err error) bool {
+	var terr *NotLockOwnerError
+	return errors.As(err, &terr)
+}
+
+var _ error = (*BucketNotFoundError)(nil)
+
+// BucketNotFoundError is returned when the bucket for the lock does not exist.
+// This is a configuration error, so it is never retried.
+type BucketNotFoundError struct {
+	bucket string
+}
+
+// NewBucketNotFoundError creates an instance of a BucketNotFoundError.
+func NewBucketNotFoundError(bucket string) *BucketNotFoundError {
+	return &BucketNotFoundError{
+		bucket: bucket,
+	}
+}
+
+// Error implements the error interface.
+func (e *BucketNotFoundError) Error() string {
+	return fmt.Sprintf("bucket %q does not exist", e.bucket)
+}
+
+// Is implements the error comparison interface.
+func (e *BucketNotFoundError) Is(err error) bool {
+	var terr *BucketNotFoundError
+	return errors.As(err, &terr)
+}
+
+var _ error = (*PermissionDeniedError)(nil)
+
+// PermissionDeniedError is returned when the credentials are not authorized to
+// read or write the lock object. This is a configuration error, so it is never
+// retried.
+type PermissionDeniedError struct {
+	bucket string
+	object string
+	err    error
+}
+
+// NewPermissionDeniedError creates an instance of a PermissionDeniedError. The
+// given error is the underlying upstream API error, and may be nil.
+func NewPermissionDeniedError(bucket, object string, err error) *PermissionDeniedError {
+	return &PermissionDeniedError{
+		bucket: bucket,
+		object: object,
+		err:    err,
+	}
+}
+
+// Error implements the error interface.
+func (e *PermissionDeniedError) Error() string {
+	msg := fmt.Sprintf("permission denied on gs://%s/%s", e.bucket, e.object)
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying upstream API error.
+func (e *PermissionDeniedError) Unwrap() error {
+	return e.err
+}
+
+// Is implements the error comparison interface.
+func (e *PermissionDeniedError) Is(err error) bool {
+	var terr *PermissionDeniedError
+	return errors.As(err, &terr)
+}
+
+var _ error = (*ConfigurationError)(nil)
+
+// ConfigurationError is returned when the lock options are incompatible with
+// each other, such as [WithHTTPClient] with [WithGRPC], or with the
+// configuration of the bucket, such as [WithPredefinedACL] on a bucket with
+// uniform bucket-level access. It is never retried.
+type ConfigurationError struct {
+	bucket string
+	object string
+	reason string
+	err    error
+}
+
+// NewConfigurationError creates an instance of a ConfigurationError. The given
+// error is the underlying upstream API error, and may be nil.
+func NewConfigurationError(bucket, object, reason string, err error) *ConfigurationError {
+	return &ConfigurationError{
+		bucket: bucket,
+		object: object,
+		reason: reason,
+		err:    err,
+	}
+}
+
+// Error implements the error interface.
+func (e *ConfigurationError) Error() string {
+	msg := fmt.Sprintf("invalid configuration for gs://%s/%s: %s", e.bucket, e.object, e.reason)
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying upstream API error.
+func (e *ConfigurationError) Unwrap() error {
+	return e.err
+}
+
+// Is implements the error comparison interface.
+func (e *ConfigurationError) Is(err error) bool {
+	var terr *ConfigurationError
+	return errors.As(err, &terr)
+}
+
+var _ error = (*GenerationMismatchError)(nil)
+
+// GenerationMismatchError is returned by [Lock.CompareAndAcquire] when the lock
+// object is not at the expected generation.
+type GenerationMismatchError struct {
+	bucket   string
+	object   string
+	expected int64
+}
+
+// NewGenerationMismatchError creates an instance of a GenerationMismatchError.
+func NewGenerationMismatchError(bucket, object string, expected int64) *GenerationMismatchError {
+	return &GenerationMismatchError{
+		bucket:   bucket,
+		object:   object,
+		expected: expected,
+	}
+}
+
+// Error implements the error interface.
+func (e *GenerationMismatchError) Error() string {
+	return fmt.Sprintf("lock gs://%s/%s is not at generation %d", e.bucket, e.object, e.expected)
+}
+
+// Expected returns the generation the caller expected the lock object to be
+// at. Zero means the object was expected to not exist.
+func (e *GenerationMismatchError) Expected() int64 {
+	return e.expected
+}
+
+// Is implements the error comparison interface.
+func (e *GenerationMismatchError) Is(err error) bool {
+	var terr *GenerationMismatchError
+	return errors.As(err, &terr)
+}
+
+var _ error = (*PredicateFailedError)(nil)
+
+// PredicateFailedError is returned by [Lock.AcquireIf] when the predicate
+// rejects the current state of the lock object.
+type PredicateFailedError struct {
+	bucket string
+	object string
+	info   *LockInfo
+}
+
+// NewPredicateFailedError creates an instance of a PredicateFailedError for the
+// given state of the lock object, which may be nil.
+func NewPredicateFailedError(bucket, object string, info *LockInfo) *PredicateFailedError {
+	return &PredicateFailedError{
+		bucket: bucket,
+		object: object,
+		info:   info,
+	}
+}
+
+// Error implements the error interface.
+func (e *PredicateFailedError) Error() string {
+	return fmt.Sprintf("predicate rejected lock gs://%s/%s", e.bucket, e.object)
+}
+
+// Info returns the state of the lock object that the predicate rejected, or
+// nil if it is unknown.
+func (e *PredicateFailedError) Info() *LockInfo {
+	if e.info == nil {
+		return nil
+	}
+	return e.info.clone()
+}
+
+// Is implements the error comparison interface.
+func (e *PredicateFailedError) Is(err error) bool {
+	var terr *PredicateFailedError
+	return errors.As(err, &terr)
+}
+
+var _ error = (*CorruptLockError)(nil)
+
+// CorruptLockError is returned when [WithStrictMetadata] is configured and the
+// lock object exists but does not have a parseable expiration, which usually
+// means it was not written by gcslock.
+type CorruptLockError struct {
+	bucket string
+	object string
+	reason string
+}
+
+// NewCorruptLockError creates an instance of a CorruptLockError.
+func NewCorruptLockError(bucket, object, reason string) *CorruptLockError {
+	return &CorruptLockError{
+		bucket: bucket,
+		object: object,
+		reason: reason,
+	}
+}
+
+// Error implements the error interface.
+func (e *CorruptLockError) Error() string {
+	return fmt.Sprintf("lock gs://%s/%s is corrupt: %s", e.bucket, e.object, e.reason)
+}
+
+// Is implements the error comparison interface.
+func (e *CorruptLockError) Is(err error) bool {
+	var terr *CorruptLockError
+	return errors.As(err, &terr)
+}
+
 // Verify that the Lock implements the interface.
 var _ Lockable = (*Lock)(nil)
 
@@ -97,144 +471,2191 @@ type Lock struct {
 	bucket string
 	object string
 
-	retryPolicy retry.Backoff
+	// retryPolicy, contentionPolicy, and contentionBackoff build a new backoff
+	// for each call, since backoffs are stateful.
+	retryPolicy       func() retry.Backoff
+	contentionPolicy  func() retry.Backoff
+	contentionBackoff func() retry.Backoff
+
+	clientOpts             []option.ClientOption
+	clampToContextDeadline bool
+	retryJitterPercent     uint64
+	chunkSize              int
+	cacheControl           string
+	kmsKeyName             string
+	force                  bool
+	requestReason          string
+	dryRun                 bool
+	metadata               map[string]string
+	maxTTL                 time.Duration
+	ttlRoundUp             bool
+	stateCacheTTL          time.Duration
+	grpc                   bool
+	operationTimeout       time.Duration
+	createBucketProject    string
+	createBucketAttrs      *storage.BucketAttrs
+	storageRetryOpts       []storage.RetryOption
+	onRetry                func(attempt int, err error)
+	httpClient             *http.Client
+	objectTemplate         func(time.Time) string
+	owner                  string
+	exponentialBase        time.Duration
+	exponentialCap         time.Duration
+	maxRetries             uint64
+	userAgentSuffix        string
+	disableCompression     bool
+	rfc3339Timestamps      bool
+	clockSkew              time.Duration
+	skipPreRead            bool
+	fallbackBucket         string
+	bodyWriter             func(w io.Writer, info LockInfo) error
+	strictMetadata         bool
+	unwrappedErrors        bool
+	endpoint               string
+	autoDelete             bool
+	autoDeleteAfter        time.Duration
+	idempotencyKey         string
+	trackAcquiredAt        bool
+	minAcquireInterval     time.Duration
+	verifyAfterWrite       bool
+	storageClass           string
+	stickyGrace            time.Duration
+	maxConnsPerHost        int
+	predefinedACL          string
+	onAcquire              func(ctx context.Context, info LockInfo) error
+	defaultCtx             context.Context //nolint:containedctx // Opt-in with WithDefaultContext.
+
+	// nowFunc returns the current time. It is a field so tests can control the
+	// clock.
+	nowFunc func() time.Time
+
+	// ownsClient indicates whether Close should close the storage client. It is
+	// false for locks that share a client with another lock.
+	ownsClient bool
+
+	// skewClient is the HTTP client used by [Lock.EstimateClockSkew]. It is a
+	// pointer so that locks sharing a storage client also share it.
+	skewClient *skewClient
+
+	// state is the mutable state of the lock. It is a pointer so that copies of
+	// the configuration above do not copy the mutex.
+	state *lockState
+}
+
+// lockState describes the lease most recently acquired by this process.
+type lockState struct {
+	mu             sync.Mutex
+	generation     int64
+	metageneration int64
+	closed         bool
+
+	// cachedInfo is the result of the last read, if the state cache is enabled.
+	cachedInfo *LockInfo
+	cachedAt   time.Time
+
+	// object is the current lock object when an object template is configured.
+	object string
+
+	// token is the ownership token from our most recent write.
+	token string
+
+	// notBefore is the expiration from our most recent write.
+	notBefore time.Time
+
+	// lastAcquire is the time of the last successful acquisition by this
+	// process, for [WithMinAcquireInterval].
+	lastAcquire time.Time
+
+	// acquiredAt is the acquired_at value from our most recent write, if
+	// [WithTrackAcquiredAt] is set.
+	acquiredAt string
+
+	// fallback is true if the fallback bucket is in use.
+	fallback bool
+
+	// renewMu serializes calls to [Lock.RenewToAtLeast].
+	renewMu sync.Mutex
+
+	stats    lockStats
+	draining atomic.Bool
 }
 
 // New creates a new distributed locking handler on the specific object in
-// Google Cloud. It does create the lock until Acquire is called.
+// Google Cloud. It does create the lock until Acquire is called. The given
+// options are passed to the underlying storage client. To configure the
+// behavior of the lock itself, use [NewWithOptions].
 func New(ctx context.Context, bucket, object string, opts ...option.ClientOption) (*Lock, error) {
-	// Append our user agent, but make it first so that subsequent options can
-	// override it.
-	opts = append([]option.ClientOption{option.WithUserAgent(userAgent)}, opts...)
+	return NewWithOptions(ctx, bucket, object, WithClientOptions(opts...))
+}
 
-	// Create the Google Cloud Storage client.
-	client, err := storage.NewClient(ctx, opts...)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create storage client: %w", err)
+// NewWithOptions is like [New], but accepts options that configure the lock.
+// Storage client options can be provided with [WithClientOptions].
+func NewWithOptions(ctx context.Context, bucket, object string, opts ...Option) (*Lock, error) {
+	if err := validateBucketName(bucket); err != nil {
+		return nil, fmt.Errorf("invalid bucket: %w", err)
+	}
+	if err := validateObjectName(object); err != nil {
+		return nil, fmt.Errorf("invalid object: %w", err)
 	}
 
-	// Set a default retry policy. This is for failed API calls, not for failed
-	// lock attempts.
-	retryPolicy := retry.WithMaxRetries(5, retry.NewFibonacci(50*time.Millisecond))
+	l := &Lock{
+		bucket: bucket,
+		object: object,
 
-	return &Lock{
-		client:      client,
-		bucket:      bucket,
-		object:      object,
-		retryPolicy: retryPolicy,
-	}, nil
-}
+		retryJitterPercent: defaultRetryJitterPercent,
+		maxRetries:         defaultMaxRetries,
+		chunkSize:          defaultChunkSize,
+		cacheControl:       defaultCacheControl,
 
-// Acquire attempts to acquire the lock. It returns [ErrLockHeld] if the lock is
-// already held. Callers can cast the error type to get more specific
-// information like the TTL expiration time:
-//
-//	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
-//	  var lockErr *ErrLockHeld
-//	  if errors.As(err, &lockErr) {
-//	    log.Printf("lock is held until %s", lockErr.NotBefore())
-//	  }
-//	}
-//
-// It automatically retries transient upstream API errors, but returns
-// immediately for errors that are irrecoverable.
-func (l *Lock) Acquire(ctx context.Context, ttl time.Duration) error {
-	now := time.Now().UTC()
+		nowFunc:    time.Now,
+		ownsClient: true,
+		skewClient: new(skewClient),
+		state:      new(lockState),
+	}
 
-	if err := retry.Do(ctx, l.retryPolicy, func(ctx context.Context) error {
-		return l.tryAcquire(ctx, now, ttl)
-	}); err != nil {
-		return fmt.Errorf("failed to acquire lock: %w", err)
+	for _, opt := range opts {
+		if err := opt(l); err != nil {
+			return nil, fmt.Errorf("failed to apply option: %w", err)
+		}
+	}
+	if err := l.validateOptions(); err != nil {
+		return nil, err
 	}
 
-	return nil
+	// Set a default retry policy. This is for failed API calls, not for failed
+	// lock attempts.
+	l.retryPolicy = func() retry.Backoff {
+		var backoff retry.Backoff = retry.NewFibonacci(50 * time.Millisecond)
+		if l.exponentialBase > 0 {
+			backoff = retry.WithCappedDuration(l.exponentialCap, retry.NewExponential(l.exponentialBase))
+		}
+		if l.retryJitterPercent > 0 {
+			backoff = retry.WithJitterPercent(l.retryJitterPercent, backoff)
+		}
+		return retry.WithMaxRetries(l.maxRetries, backoff)
+	}
+
+	client, err := l.newClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.client = client
+
+	return l, nil
 }
 
-// Close terminates the client connection. It does not delete the lock.
-func (l *Lock) Close(_ context.Context) error {
-	if err := l.client.Close(); err != nil {
-		return fmt.Errorf("failed to close storage client: %w", err)
+// validateOptions returns a [*ConfigurationError] if the configured options
+// cannot be combined.
+func (l *Lock) validateOptions() error {
+	if l.grpc {
+		if l.httpClient != nil {
+			return NewConfigurationError(l.bucket, l.object, "WithHTTPClient is not supported with WithGRPC", nil)
+		}
+		if l.maxConnsPerHost > 0 {
+			return NewConfigurationError(l.bucket, l.object, "WithMaxConnsPerHost is not supported with WithGRPC", nil)
+		}
+		if l.idempotencyKey != "" {
+			return NewConfigurationError(l.bucket, l.object, "WithIdempotencyKey is not supported with WithGRPC", nil)
+		}
+	}
+	if l.httpClient != nil && l.maxConnsPerHost > 0 {
+		return NewConfigurationError(l.bucket, l.object, "WithMaxConnsPerHost is not supported with WithHTTPClient", nil)
 	}
 	return nil
 }
 
-// tryAcquire is the internal implementation of [Acquire] that actually creates
-// and updates the lock.
-func (l *Lock) tryAcquire(ctx context.Context, now time.Time, ttl time.Duration) error {
-	now = now.Truncate(time.Second)
-	ttl = ttl.Truncate(time.Second)
-	objHandle := l.client.Bucket(l.bucket).Object(l.object)
+// newClient creates a Google Cloud Storage client from the configured client
+// options, followed by any extra options.
+func (l *Lock) newClient(ctx context.Context, extra ...option.ClientOption) (*storage.Client, error) {
+	clientOpts, ua := l.clientOptions(extra...)
 
-	// Try to get the attributes on the object.
-	attrs, err := objHandle.Attrs(ctx)
-	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
-		return fmt.Errorf("failed to get storage object: %w", err)
+	// A custom HTTP client is used as-is by the storage client, which ignores
+	// the user agent option, so set the user agent on its transport instead.
+	var httpClient *http.Client
+	if l.httpClient != nil {
+		httpClient = withUserAgent(l.httpClient, ua)
 	}
 
-	// If we found the object, check if the lock is valid and held.
-	if attrs != nil && attrs.Metadata != nil {
-		nbf, ok := attrs.Metadata[notBeforeKey]
-		if !ok {
-			nbf = "0"
-		}
-
-		nbfUnix, err := strconv.ParseInt(nbf, 10, 64)
+	// The idempotency token and connection limits must be set on the transport,
+	// so build the HTTP client the storage client would otherwise build for
+	// itself.
+	if httpClient == nil && !l.grpc && (l.idempotencyKey != "" || l.maxConnsPerHost > 0) {
+		c, err := l.newHTTPClient(ctx, clientOpts)
 		if err != nil {
-			return fmt.Errorf("failed to parse nbf as an integer: %w", err)
-		}
-
-		if nbfUnix >= now.Unix() {
-			return NewLockHeldError(nbfUnix)
+			return nil, err
 		}
+		httpClient = c
+	}
+	if l.idempotencyKey != "" && !l.grpc {
+		httpClient = withIdempotencyToken(httpClient)
 	}
 
-	// If we got this far, it means the lock object either does not exist, or it
-	// exists but is past the TTL. Therefore we need to create/update the file,
-	// taking into account the possibility that competing processes are fighting
-	// for the lock.
+	if httpClient != nil {
+		clientOpts = append(clientOpts, option.WithHTTPClient(httpClient))
+	}
 
-	// If generation and metageneration are 0, then we should only create the
-	// object if it does not exist. Otherwise, we should only perform an update if
-	// the metagenerations match.
-	var conds storage.Conditions
-	if attrs == nil {
-		// The object did not exist, so ensure it does not exist when we write.
-		conds = storage.Conditions{
-			DoesNotExist: true,
-		}
-	} else {
-		// The object exists, so set metadata to ensure we catch a race.
-		conds = storage.Conditions{
-			GenerationMatch:     attrs.Generation,
-			MetagenerationMatch: attrs.Metageneration,
+	// If gRPC was requested but the client cannot be constructed, fall back to
+	// JSON over HTTP.
+	if l.grpc {
+		if client, err := storage.NewGRPCClient(ctx, clientOpts...); err == nil {
+			return client, nil
 		}
 	}
 
-	w := objHandle.If(conds).NewWriter(ctx)
-	w.CacheControl = defaultCacheControl
-	w.ChunkSize = defaultChunkSize
-	w.SendCRC32C = true
-	if w.Metadata == nil {
-		w.Metadata = make(map[string]string)
+	client, err := storage.NewClient(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+	return client, nil
+}
+
+// clientOptions returns the storage client options from the configured options,
+// followed by any extra options, and the user agent they set.
+func (l *Lock) clientOptions(extra ...option.ClientOption) ([]option.ClientOption, string) {
+	// Append our user agent, but make it first so that subsequent options can
+	// override it.
+	ua := userAgent
+	if l.userAgentSuffix != "" {
+		ua += " " + l.userAgentSuffix
 	}
-	w.Metadata[notBeforeKey] = strconv.FormatInt(now.Add(ttl).Unix(), 10)
+	clientOpts := append([]option.ClientOption{option.WithUserAgent(ua)}, l.clientOpts...)
+	if l.endpoint != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(l.endpoint))
+	}
+	clientOpts = append(clientOpts, extra...)
+	return clientOpts, ua
+}
 
-	// Write the metadata back to the object.
-	if err := w.Close(); err != nil {
-		var googleErr *googleapi.Error
-		if errors.As(err, &googleErr) {
-			switch googleErr.Code {
-			case http.StatusNotFound:
-				// The object was deleted between when we read attributes and now.
-				return retry.RetryableError(err)
-			case http.StatusPreconditionFailed:
-				// The object was modified between when we read attributes and now.
-				return retry.RetryableError(err)
-			}
+// newHTTPClient builds an authenticated HTTP client from the client options, as
+// the storage client would, with the connection limits from
+// [WithMaxConnsPerHost] applied to its transport.
+func (l *Lock) newHTTPClient(ctx context.Context, clientOpts []option.ClientOption) (*http.Client, error) {
+	clientOpts = append(clientOpts,
+		option.WithScopes(storage.ScopeFullControl, "https://www.googleapis.com/auth/cloud-platform"))
+
+	if l.maxConnsPerHost <= 0 {
+		c, _, err := htransport.NewClient(ctx, clientOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create http client: %w", err)
 		}
+		return c, nil
+	}
 
-		return fmt.Errorf("failed to update object: %w", err)
+	// The default transport may have been replaced, so only clone it if it is
+	// still an *http.Transport.
+	base := &http.Transport{}
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		base = t.Clone()
 	}
+	base.MaxConnsPerHost = l.maxConnsPerHost
+	base.MaxIdleConnsPerHost = l.maxConnsPerHost
 
-	return nil
+	transport, err := htransport.NewTransport(ctx, base, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http client: %w", err)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// WithDefaultContext returns a shallow copy of the lock whose methods use ctx in
+// place of a per-call context that is nil or [context.TODO]. Any other per-call
+// context, including [context.Background], takes precedence and is used as-is;
+// the two are never merged. The copy shares its client and lease state with the
+// original, so closing either closes both.
+//
+// This is a convenience for simple programs that use a single context
+// throughout. Libraries and servers should pass a context to every call
+// instead.
+func (l *Lock) WithDefaultContext(ctx context.Context) *Lock {
+	clone := *l
+	clone.defaultCtx = ctx
+	return &clone
+}
+
+// resolveContext returns the default context from [Lock.WithDefaultContext] if
+// ctx is nil or [context.TODO], and ctx otherwise.
+func (l *Lock) resolveContext(ctx context.Context) context.Context {
+	if l.defaultCtx != nil && (ctx == nil || ctx == context.TODO()) {
+		return l.defaultCtx
+	}
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// Bucket returns the name of the bucket that stores the lock object. If a
+// fallback bucket is configured with [WithFallbackBucket], it returns the
+// bucket used by the most recent acquisition.
+func (l *Lock) Bucket() string {
+	return l.bucketName()
+}
+
+// Object returns the name of the lock object. If an object template is
+// configured with [WithObjectTemplate], it returns the object from the most
+// recent acquisition, or the template evaluated at the current time if the lock
+// has not been acquired.
+func (l *Lock) Object() string {
+	return l.objectName()
+}
+
+// ForObject returns a new lock for a different object in the same bucket,
+// without creating another storage client. The new lock shares the client and
+// configuration of l, including the retry policy, but has its own lease state,
+// and its calls do not consume the retry budget of l. Closing it does not close
+// the shared client, so l must outlive it. Unlike [NewWithOptions], the object
+// name is not validated up front; an invalid name fails when the lock is used.
+func (l *Lock) ForObject(object string) *Lock {
+	return l.withObject(object)
+}
+
+// SameTarget returns true if l and other currently target the same bucket and
+// object, as returned by [Lock.Bucket] and [Lock.Object], even if they were
+// created independently. Two such locks contend with each other, so callers
+// can use this to deduplicate locks in a registry. It returns false if either
+// lock is nil.
+func (l *Lock) SameTarget(other *Lock) bool {
+	if l == nil || other == nil {
+		return false
+	}
+	return l.Bucket() == other.Bucket() && l.Object() == other.Object()
+}
+
+// Acquire attempts to acquire the lock. It returns a [*LockHeldError] if the
+// lock is already held, which matches [ErrLockHeld] with [errors.Is]. Callers
+// can cast the error type to get more specific information like the TTL
+// expiration time:
+//
+//	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+//	  var lockErr *LockHeldError
+//	  if errors.As(err, &lockErr) {
+//	    log.Printf("lock is held until %s", lockErr.NotBefore())
+//	  }
+//	}
+//
+// It automatically retries transient upstream API errors, but returns
+// immediately for errors that are irrecoverable.
+func (l *Lock) Acquire(ctx context.Context, ttl time.Duration) error {
+	ctx = l.resolveContext(ctx)
+
+	_, err := l.AcquireLease(ctx, ttl)
+	return err
+}
+
+// AcquireLease is like [Lock.Acquire], but it also returns the not-before time
+// that was written to the lock object. Because timestamps are truncated to the
+// second, this may differ slightly from the current time plus the ttl. Callers
+// can use the returned value to schedule renewals without re-reading the object.
+func (l *Lock) AcquireLease(ctx context.Context, ttl time.Duration) (time.Time, error) {
+	ctx = l.resolveContext(ctx)
+
+	lease, err := l.acquire(ctx, ttl)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return lease.NotBefore, nil
+}
+
+// TryAcquireWithInfo is like [Lock.Acquire], but it reports contention as a
+// result instead of an error. If the lock was acquired, it returns true. If the
+// lock is held by another process, it returns false and the state of the lock
+// object, such as its owner and expiration; the expiration is as stored, and
+// does not include any allowance from [WithClockSkew] or [WithStickyOwner].
+// The error is reserved for genuine failures, such as an unreachable bucket.
+// This suits polling schedulers that attempt the lock once per tick.
+func (l *Lock) TryAcquireWithInfo(ctx context.Context, ttl time.Duration) (acquired bool, info *LockInfo, err error) {
+	ctx = l.resolveContext(ctx)
+
+	if _, err := l.acquire(ctx, ttl); err != nil {
+		var lockErr *LockHeldError
+		if !errors.As(err, &lockErr) {
+			return false, nil, err
+		}
+		if lockErr.info == nil {
+			return false, &LockInfo{
+				Object:    l.objectName(),
+				NotBefore: lockErr.NotBefore(),
+				Owner:     lockErr.Owner(),
+			}, nil
+		}
+		return false, lockErr.info.clone(), nil
+	}
+	return true, nil, nil
+}
+
+// AcquireAs is like [Lock.Acquire], but it performs the acquisition with the
+// given credentials instead of those the lock was created with, for example
+// [option.WithTokenSource] for the service account of the current tenant. The
+// lease is recorded on this lock, so it can later be renewed or released, but
+// those calls use the lock's own credentials.
+//
+// Each call creates and closes a short-lived storage client with the lock's
+// client options followed by creds, which costs a new connection and token
+// exchange. Nothing is cached between calls. Callers that acquire frequently on
+// behalf of the same tenant should instead create a [Lock] per tenant with
+// [WithClientOptions]. If a custom HTTP client is configured with
+// [WithHTTPClient], it carries its own credentials and creds has no effect.
+func (l *Lock) AcquireAs(ctx context.Context, ttl time.Duration, creds option.ClientOption) error {
+	ctx = l.resolveContext(ctx)
+
+	client, err := l.newClient(ctx, creds)
+	if err != nil {
+		return l.acquireError(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// Share the lease state, but not the client.
+	clone := *l
+	clone.client = client
+	clone.ownsClient = false
+
+	_, err = clone.acquire(ctx, ttl)
+	return err
+}
+
+// AcquireResult describes a single call to [Lock.AcquireResult].
+type AcquireResult struct {
+	// Attempts is the number of attempts made, including the first.
+	Attempts int
+
+	// Duration is how long the call took, including retries.
+	Duration time.Duration
+
+	// NotBefore is the time at which the lease expires.
+	NotBefore time.Time
+}
+
+// AcquireResult is like [Lock.Acquire], but it also reports how many attempts
+// were made and how long they took, which is useful for capacity planning.
+func (l *Lock) AcquireResult(ctx context.Context, ttl time.Duration) (*AcquireResult, error) {
+	ctx = l.resolveContext(ctx)
+
+	start := time.Now()
+	lease, err := l.acquire(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &AcquireResult{
+		Attempts:  lease.attempts,
+		Duration:  time.Since(start),
+		NotBefore: lease.NotBefore,
+	}, nil
+}
+
+// AcquireFenced is like [Lock.Acquire], but it also returns a fencing token for
+// the acquired lease. The token is the generation of the lock object, which
+// Google Cloud Storage increases on every write, so a lease acquired later
+// always has a larger token than one acquired earlier.
+//
+// Fencing tokens protect shared state from a process that lost the lock but
+// does not know it yet (for example, after a long garbage collection pause).
+// Callers should include the token in every request to the downstream system
+// protected by the lock, and that system should remember the largest token it
+// has seen and reject any request with a smaller one.
+func (l *Lock) AcquireFenced(ctx context.Context, ttl time.Duration) (int64, error) {
+	ctx = l.resolveContext(ctx)
+
+	lease, err := l.acquire(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+	return lease.Generation, nil
+}
+
+// acquire is the shared implementation of the Acquire methods. It validates the
+// ttl and acquires a lease starting now.
+func (l *Lock) acquire(ctx context.Context, ttl time.Duration) (*Lease, error) {
+	return l.acquireMatching(ctx, ttl, nil)
+}
+
+// acquireMatching is like [Lock.acquire], but if pred is not nil, an existing
+// lock object that is not held is only replaced if pred returns true for it.
+func (l *Lock) acquireMatching(ctx context.Context, ttl time.Duration, pred func(LockInfo) bool) (*Lease, error) {
+	if err := l.validateTTL(ttl); err != nil {
+		return nil, l.acquireError(err)
+	}
+
+	now := l.now()
+
+	if l.clampToContextDeadline {
+		var err error
+		ttl, err = clampTTL(ctx, now, ttl)
+		if err != nil {
+			return nil, l.acquireError(err)
+		}
+
+		// The deadline may leave less than the minimum ttl.
+		if err := l.validateTTL(ttl); err != nil {
+			return nil, l.acquireError(err)
+		}
+	}
+
+	return l.acquireNotBefore(ctx, now, l.notBefore(now, ttl), pred)
+}
+
+// AcquireUntil is like [Lock.Acquire], but the lease expires at the given
+// absolute time instead of after a duration. The expiration is written as
+// until truncated to the second, which avoids the additional truncation of the
+// current time that converting to a ttl would incur. It returns an error if
+// until is not in the future, or if it exceeds the maximum ttl configured with
+// [WithMaxTTL].
+func (l *Lock) AcquireUntil(ctx context.Context, until time.Time) error {
+	ctx = l.resolveContext(ctx)
+
+	now := l.now()
+	if !until.After(now) {
+		return l.acquireError(fmt.Errorf("until %s is not in the future",
+			until.UTC().Format(time.RFC3339)))
+	}
+	if l.maxTTL > 0 && until.Sub(now) > l.maxTTL {
+		return l.acquireError(fmt.Errorf("until %s exceeds maximum of %s",
+			until.UTC().Format(time.RFC3339), l.maxTTL))
+	}
+
+	_, err := l.acquireNotBefore(ctx, now, until.UTC().Truncate(time.Second), nil)
+	return err
+}
+
+// AcquireAt reserves the lock for the window starting at notBefore and lasting
+// for ttl. The lock object only stores an expiration, so the lock is held from
+// the time AcquireAt returns until notBefore plus the ttl. Like [Lock.Acquire],
+// it returns a [*LockHeldError] if any other lease is currently held, which
+// prevents two processes from reserving overlapping windows.
+//
+// It returns an error if notBefore is in the past. If a maximum ttl is
+// configured with [WithMaxTTL], it applies to the entire reservation.
+func (l *Lock) AcquireAt(ctx context.Context, notBefore time.Time, ttl time.Duration) error {
+	ctx = l.resolveContext(ctx)
+
+	if err := l.validateTTL(ttl); err != nil {
+		return l.acquireError(err)
+	}
+
+	now := l.now()
+	if notBefore.Before(now) {
+		return l.acquireError(fmt.Errorf("not-before %s is in the past",
+			notBefore.UTC().Format(time.RFC3339)))
+	}
+
+	nbf := l.notBefore(notBefore.UTC(), ttl)
+	if l.maxTTL > 0 && nbf.Sub(now) > l.maxTTL {
+		return l.acquireError(fmt.Errorf("reservation until %s exceeds maximum of %s",
+			nbf.Format(time.RFC3339), l.maxTTL))
+	}
+
+	_, err := l.acquireNotBefore(ctx, now, nbf, nil)
+	return err
+}
+
+// CompareAndAcquire acquires the lock only if the lock object is at the
+// expected generation, such as one observed earlier with [Lock.Info]. An
+// expected generation of zero means the object must not exist. If the object
+// is at any other generation, it returns a [*GenerationMismatchError].
+//
+// Unlike [Lock.Acquire], it does not read the object first or check whether
+// the current lease has expired. The caller is fully responsible for deciding
+// when it is safe to take the lock.
+func (l *Lock) CompareAndAcquire(ctx context.Context, expectedGen int64, ttl time.Duration) error {
+	ctx = l.resolveContext(ctx)
+
+	if l.state.draining.Load() {
+		return l.acquireError(ErrDraining)
+	}
+	if err := l.validateTTL(ttl); err != nil {
+		return l.acquireError(err)
+	}
+
+	now := l.now()
+	if err := l.resolveObject(now); err != nil {
+		return l.acquireError(err)
+	}
+	nbf := l.notBefore(now, ttl)
+
+	if l.dryRun {
+		if err := l.retry(ctx, func(ctx context.Context) error {
+			return l.checkGeneration(ctx, expectedGen)
+		}); err != nil {
+			return l.acquireError(err)
+		}
+		return nil
+	}
+
+	conds := storage.Conditions{GenerationMatch: expectedGen}
+	if expectedGen == 0 {
+		conds = storage.Conditions{DoesNotExist: true}
+	}
+
+	// Every attempt re-issues the same write, so it uses the same token.
+	token := newToken()
+	if err := l.retry(ctx, func(ctx context.Context) error {
+		opCtx, cancel := l.operationContext(ctx)
+		defer cancel()
+
+		objHandle := l.objectHandle()
+		w := l.newWriter(opCtx, objHandle.If(conds), nbf, token)
+		if err := l.closeWriter(w, nbf); err != nil {
+			if isNotFoundOrPreconditionFailed(err) {
+				if _, berr := l.client.Bucket(l.bucketName()).Attrs(opCtx); errors.Is(berr, storage.ErrBucketNotExist) {
+					return NewBucketNotFoundError(l.bucketName())
+				}
+				return NewGenerationMismatchError(l.bucketName(), l.objectName(), expectedGen)
+			}
+			if rerr := retryThrottled(ctx, err); rerr != nil {
+				return rerr
+			}
+			return fmt.Errorf("failed to update object: %w", err)
+		}
+		l.recordWrite(w, nbf)
+		return nil
+	}); err != nil {
+		return l.acquireError(err)
+	}
+
+	if l.onAcquire != nil {
+		generation, metageneration := l.LastGeneration()
+		if err := l.runOnAcquire(ctx, &Lease{
+			NotBefore:      nbf,
+			Generation:     generation,
+			Metageneration: metageneration,
+		}); err != nil {
+			return l.acquireError(err)
+		}
+	}
+	l.state.stats.acquires.Add(1)
+
+	return nil
+}
+
+// checkGeneration reads the lock object and returns a [*GenerationMismatchError]
+// unless it is at the expected generation, where zero means it must not exist.
+// It is the read-only equivalent of the write in [Lock.CompareAndAcquire], for
+// [WithDryRun].
+func (l *Lock) checkGeneration(ctx context.Context, expectedGen int64) error {
+	opCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	var generation int64
+	attrs, err := l.objectHandle().Attrs(opCtx)
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		if _, berr := l.client.Bucket(l.bucketName()).Attrs(opCtx); errors.Is(berr, storage.ErrBucketNotExist) {
+			return NewBucketNotFoundError(l.bucketName())
+		}
+	case err != nil:
+		if rerr := retryThrottled(ctx, err); rerr != nil {
+			return rerr
+		}
+		return fmt.Errorf("failed to get storage object: %w", err)
+	default:
+		generation = attrs.Generation
+	}
+
+	if generation != expectedGen {
+		return NewGenerationMismatchError(l.bucketName(), l.objectName(), expectedGen)
+	}
+	return nil
+}
+
+// AcquireIf is like [Lock.Acquire], but an existing lock object that is not
+// held is only replaced if pred returns true for it. If pred returns false, it
+// returns a [*PredicateFailedError]. This allows conditional takeovers, such as
+// only replacing an expired holder that recorded an older version in its
+// metadata. If the object does not exist, pred is not called.
+//
+// The predicate is an extra check on top of the expiration check, so a lease
+// that has not expired is never taken over and [*LockHeldError] is returned as
+// usual. If another process writes in between reading and writing the object,
+// it is read again and the predicate is re-run according to the retry policy.
+// The predicate may therefore be called more than once, and should not have
+// side effects.
+func (l *Lock) AcquireIf(ctx context.Context, ttl time.Duration, pred func(LockInfo) bool) error {
+	ctx = l.resolveContext(ctx)
+
+	if pred == nil {
+		return l.acquireError(fmt.Errorf("predicate cannot be nil"))
+	}
+
+	_, err := l.acquireMatching(ctx, ttl, pred)
+	return err
+}
+
+// acquireNotBefore retries [tryAcquire] according to the retry policy, writing the
+// given not-before time if the lock is available at now and pred, if not nil,
+// holds for the existing lock object.
+func (l *Lock) acquireNotBefore(ctx context.Context, now, nbf time.Time, pred func(LockInfo) bool) (*Lease, error) {
+	if l.state.draining.Load() {
+		return nil, l.acquireError(ErrDraining)
+	}
+	if err := l.checkAcquireInterval(now); err != nil {
+		return nil, l.acquireError(err)
+	}
+	if err := l.resolveObject(now); err != nil {
+		return nil, l.acquireError(err)
+	}
+
+	// Always start with the primary bucket, in case it has recovered.
+	l.useFallbackBucket(false)
+
+	result, attempts, err := l.retryAcquire(ctx, now, nbf, pred)
+	if err != nil && l.fallbackBucket != "" && isUnavailable(err) {
+		l.useFallbackBucket(true)
+
+		var fallbackAttempts int
+		result, fallbackAttempts, err = l.retryAcquire(ctx, now, nbf, pred)
+		attempts += fallbackAttempts
+	}
+	if err != nil {
+		var lockErr *LockHeldError
+		if errors.As(err, &lockErr) {
+			l.state.stats.heldRejections.Add(1)
+		}
+		return nil, l.acquireError(err)
+	}
+
+	if l.onAcquire != nil && !l.dryRun {
+		if err := l.runOnAcquire(ctx, result); err != nil {
+			return nil, l.acquireError(err)
+		}
+	}
+
+	if !l.dryRun {
+		l.state.stats.acquires.Add(1)
+	}
+	if l.minAcquireInterval > 0 {
+		l.state.mu.Lock()
+		l.state.lastAcquire = now
+		l.state.mu.Unlock()
+	}
+	result.attempts = attempts
+	return result, nil
+}
+
+// runOnAcquire calls the [WithOnAcquire] hook for the lease just written. If
+// the hook fails, the lease is released before returning the hook error.
+func (l *Lock) runOnAcquire(ctx context.Context, lease *Lease) error {
+	metadata := make(map[string]string, len(l.metadata))
+	for k, v := range l.metadata {
+		metadata[k] = v
+	}
+
+	info := LockInfo{
+		Object:         l.objectName(),
+		NotBefore:      lease.NotBefore,
+		Generation:     lease.Generation,
+		Metageneration: lease.Metageneration,
+		Owner:          l.owner,
+		Metadata:       metadata,
+	}
+	if err := l.onAcquire(ctx, info); err != nil {
+		err = fmt.Errorf("on acquire hook failed: %w", err)
+
+		// The hook may have failed because the context was cancelled, so detach
+		// from it.
+		if rerr := l.Release(context.WithoutCancel(ctx)); rerr != nil {
+			err = errors.Join(err, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkAcquireInterval returns [ErrTooSoon] if the last successful acquisition
+// was within the interval configured with [WithMinAcquireInterval].
+func (l *Lock) checkAcquireInterval(now time.Time) error {
+	if l.minAcquireInterval <= 0 {
+		return nil
+	}
+
+	l.state.mu.Lock()
+	last := l.state.lastAcquire
+	l.state.mu.Unlock()
+
+	if !last.IsZero() && now.Before(last.Add(l.minAcquireInterval)) {
+		return ErrTooSoon
+	}
+	return nil
+}
+
+// acquireError wraps an error from acquiring the lock, unless
+// [WithUnwrappedErrors] is configured.
+func (l *Lock) acquireError(err error) error {
+	if l.unwrappedErrors {
+		return err
+	}
+	return fmt.Errorf("failed to acquire lock: %w", err)
+}
+
+// Drain makes all later attempts to acquire or renew the lock return
+// [ErrDraining], so that in-flight work can finish during a graceful shutdown
+// without taking new leases. Leases that are already held remain valid until
+// their ttl expires, and can still be released, expired, or transferred. It is
+// safe to call more than once.
+func (l *Lock) Drain() {
+	l.state.draining.Store(true)
+}
+
+// retryAcquire calls [tryAcquire] according to the retry policy. It returns
+// the number of attempts made.
+func (l *Lock) retryAcquire(ctx context.Context, now, nbf time.Time, pred func(LockInfo) bool) (*Lease, int, error) {
+	var result *Lease
+	var attempts int
+	var createdBucket bool
+
+	// Re-issue the same write, with the same token, until it definitively fails
+	// its precondition. The next attempt is then a different write.
+	token := newToken()
+	err := l.retry(ctx, func(ctx context.Context) error {
+		attempts++
+
+		var err error
+		result, err = l.tryAcquire(ctx, now, nbf, pred, token)
+		if isPreconditionFailed(err) {
+			token = newToken()
+		}
+
+		// Create the bucket at most once per call, and never in dry-run mode.
+		var bucketErr *BucketNotFoundError
+		if errors.As(err, &bucketErr) && l.createBucketProject != "" && !l.dryRun && !createdBucket {
+			if cerr := l.createBucket(ctx); cerr != nil {
+				return cerr
+			}
+			createdBucket = true
+			return retry.RetryableError(err)
+		}
+		return err
+	})
+	return result, attempts, err
+}
+
+// Renew extends a lease previously acquired by this process so that it expires
+// at the current time plus the ttl. Unlike [Lock.Acquire], it succeeds while
+// the lock is still held, but only if the lock object has not been modified
+// since our last write. If another process has taken or deleted the lock, it
+// returns a [*NotLockOwnerError].
+func (l *Lock) Renew(ctx context.Context, ttl time.Duration) error {
+	ctx = l.resolveContext(ctx)
+
+	if l.state.draining.Load() {
+		return fmt.Errorf("failed to renew lock: %w", ErrDraining)
+	}
+	if err := l.validateTTL(ttl); err != nil {
+		return fmt.Errorf("failed to renew lock: %w", err)
+	}
+
+	if err := l.rewrite(ctx, l.notBefore(l.now(), ttl), l.owner); err != nil {
+		return fmt.Errorf("failed to renew lock: %w", err)
+	}
+	l.state.stats.renewals.Add(1)
+	return nil
+}
+
+// RenewIfExpiringWithin is like [Lock.Renew], but it only rewrites the lock
+// object if the current lease expires within the threshold. It returns whether
+// the lease was renewed. This avoids needless writes when called frequently
+// from a renewal loop. If another process has taken or deleted the lock, it
+// returns a [*NotLockOwnerError].
+func (l *Lock) RenewIfExpiringWithin(ctx context.Context, threshold, ttl time.Duration) (bool, error) {
+	ctx = l.resolveContext(ctx)
+
+	if l.state.draining.Load() {
+		return false, fmt.Errorf("failed to renew lock: %w", ErrDraining)
+	}
+	if err := l.validateTTL(ttl); err != nil {
+		return false, fmt.Errorf("failed to renew lock: %w", err)
+	}
+
+	info, err := l.Info(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to renew lock: %w", err)
+	}
+
+	if generation, _ := l.LastGeneration(); generation == 0 || info.Generation != generation {
+		return false, fmt.Errorf("failed to renew lock: %w", NewNotLockOwnerError(l.bucketName(), l.objectName()))
+	}
+
+	if info.NotBefore.Sub(l.now()) >= threshold {
+		return false, nil
+	}
+
+	if err := l.Renew(ctx, ttl); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RenewToAtLeast extends a lease previously acquired by this process so that it
+// expires no earlier than target, truncated to the second. It reads the current
+// not-before time and only rewrites the lock object if it is before target, so
+// concurrent renewal loops do not race to extend the lease or write needlessly.
+// Calls on the same lock are serialized, and the write is conditional on the
+// lock object being unchanged since our last write. If another process has
+// taken or deleted the lock, it returns a [*NotLockOwnerError].
+//
+// It returns an error if target is not in the future, or if it exceeds the
+// maximum ttl configured with [WithMaxTTL].
+func (l *Lock) RenewToAtLeast(ctx context.Context, target time.Time) error {
+	ctx = l.resolveContext(ctx)
+
+	if l.state.draining.Load() {
+		return fmt.Errorf("failed to renew lock: %w", ErrDraining)
+	}
+
+	now := l.now()
+	if !target.After(now) {
+		return fmt.Errorf("failed to renew lock: target %s is not in the future",
+			target.UTC().Format(time.RFC3339))
+	}
+	if l.maxTTL > 0 && target.Sub(now) > l.maxTTL {
+		return fmt.Errorf("failed to renew lock: target %s exceeds maximum of %s",
+			target.UTC().Format(time.RFC3339), l.maxTTL)
+	}
+	nbf := target.UTC().Truncate(time.Second)
+
+	l.state.renewMu.Lock()
+	defer l.state.renewMu.Unlock()
+
+	info, err := l.readInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to renew lock: %w", err)
+	}
+
+	if generation, _ := l.LastGeneration(); generation == 0 || info.Generation != generation {
+		return fmt.Errorf("failed to renew lock: %w", NewNotLockOwnerError(l.bucketName(), l.objectName()))
+	}
+
+	if !info.NotBefore.Before(nbf) {
+		return nil
+	}
+
+	if err := l.rewrite(ctx, nbf, l.owner); err != nil {
+		return fmt.Errorf("failed to renew lock: %w", err)
+	}
+	l.state.stats.renewals.Add(1)
+	return nil
+}
+
+// ExtendBy extends a lease previously acquired by this process by adding delta
+// to its current expiration, instead of resetting it to the current time plus
+// a ttl like [Lock.Renew]. The delta is truncated to the second. Calls on the
+// same lock are serialized with [Lock.RenewToAtLeast], and the write is
+// conditional on the lock object being unchanged since our last write. If
+// another process has taken or deleted the lock, it returns a
+// [*NotLockOwnerError]. If the lease has already expired, another process may
+// acquire the lock at any moment, so it returns a [*LockHeldError] carrying the
+// expired not-before time instead of extending it.
+func (l *Lock) ExtendBy(ctx context.Context, delta time.Duration) error {
+	ctx = l.resolveContext(ctx)
+
+	if l.state.draining.Load() {
+		return fmt.Errorf("failed to extend lock: %w", ErrDraining)
+	}
+	if delta < time.Second {
+		return fmt.Errorf("failed to extend lock: delta %s must be at least 1s", delta)
+	}
+
+	l.state.renewMu.Lock()
+	defer l.state.renewMu.Unlock()
+
+	info, err := l.readInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to extend lock: %w", err)
+	}
+
+	if generation, _ := l.LastGeneration(); generation == 0 || info.Generation != generation {
+		return fmt.Errorf("failed to extend lock: %w", NewNotLockOwnerError(l.bucketName(), l.objectName()))
+	}
+
+	now := l.now()
+	if !info.HeldAt(now) {
+		return fmt.Errorf("failed to extend lock: %w", newLockHeldErrorFromInfo(info))
+	}
+
+	nbf := info.NotBefore.Add(delta.Truncate(time.Second))
+	if l.maxTTL > 0 && nbf.Sub(now) > l.maxTTL {
+		return fmt.Errorf("failed to extend lock: expiration %s exceeds maximum of %s",
+			nbf.Format(time.RFC3339), l.maxTTL)
+	}
+
+	if err := l.rewrite(ctx, nbf, l.owner); err != nil {
+		return fmt.Errorf("failed to extend lock: %w", err)
+	}
+	l.state.stats.renewals.Add(1)
+	return nil
+}
+
+// Expire gives up a lease previously acquired by this process by rewriting the
+// not-before time to just before the current time, so that other processes can
+// acquire the lock immediately. Unlike [Lock.Release], the lock object and its
+// metadata are preserved, which avoids churn from repeatedly creating and
+// deleting the object. The write is conditional on the lock object being
+// unchanged since our last write. If another process holds the lock, it
+// returns a [*LockHeldError].
+func (l *Lock) Expire(ctx context.Context) error {
+	ctx = l.resolveContext(ctx)
+
+	now := l.now().Truncate(time.Second)
+
+	if err := l.rewrite(ctx, now.Add(-time.Second), l.owner); err != nil {
+		var ownerErr *NotLockOwnerError
+		if errors.As(err, &ownerErr) {
+			if info, ierr := l.readInfo(ctx); ierr == nil && info.HeldAt(now) {
+				err = newLockHeldErrorFromInfo(info)
+			}
+		}
+		return fmt.Errorf("failed to expire lock: %w", err)
+	}
+	return nil
+}
+
+// Transfer hands a lease held by this process to another owner without a gap,
+// for example from an outgoing leader to its successor during a rolling
+// restart. In a single conditional write, it records newOwner as the owner of
+// the lock and extends the lease to the current time plus the ttl. If another
+// process holds the lock, it returns a [*LockHeldError].
+//
+// After a successful transfer, this process no longer holds the lease. The
+// successor, created with [WithOwner] set to newOwner, should call
+// [Lock.Refresh] to adopt the lease before renewing or releasing it.
+func (l *Lock) Transfer(ctx context.Context, newOwner string, ttl time.Duration) error {
+	ctx = l.resolveContext(ctx)
+
+	if newOwner == "" {
+		return fmt.Errorf("failed to transfer lock: new owner cannot be empty")
+	}
+	if err := l.validateTTL(ttl); err != nil {
+		return fmt.Errorf("failed to transfer lock: %w", err)
+	}
+
+	now := l.now()
+	if err := l.rewrite(ctx, l.notBefore(now, ttl), newOwner); err != nil {
+		var ownerErr *NotLockOwnerError
+		if errors.As(err, &ownerErr) {
+			if info, ierr := l.readInfo(ctx); ierr == nil && info.HeldAt(now) {
+				err = newLockHeldErrorFromInfo(info)
+			}
+		}
+		return fmt.Errorf("failed to transfer lock: %w", err)
+	}
+	l.setLastGeneration(0, 0, "")
+
+	return nil
+}
+
+// rewrite updates the not-before time and owner on a lock previously acquired
+// by this process. It only succeeds if the lock object has not been modified
+// since our last write, and otherwise returns a [*NotLockOwnerError].
+func (l *Lock) rewrite(ctx context.Context, nbf time.Time, owner string) error {
+	generation, metageneration := l.LastGeneration()
+	if generation == 0 {
+		return NewNotLockOwnerError(l.bucketName(), l.objectName())
+	}
+	if err := l.verifyOwner(ctx, generation); err != nil {
+		return err
+	}
+
+	opCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	objHandle := l.objectHandle()
+	w := l.newWriter(opCtx, objHandle.If(storage.Conditions{
+		GenerationMatch:     generation,
+		MetagenerationMatch: metageneration,
+	}), nbf, newToken())
+
+	// The lease is the same, so keep its token and acquisition time.
+	if token := l.lastToken(); token != "" {
+		w.Metadata[tokenKey] = token
+	}
+	if acquiredAt := l.lastAcquiredAt(); l.trackAcquiredAt && acquiredAt != "" {
+		w.Metadata[acquiredAtKey] = acquiredAt
+	}
+	if owner == "" {
+		delete(w.Metadata, ownerKey)
+	} else {
+		w.Metadata[ownerKey] = owner
+	}
+
+	if err := l.closeWriter(w, nbf); err != nil {
+		if isNotFoundOrPreconditionFailed(err) {
+			l.setLastGeneration(0, 0, "")
+			return NewNotLockOwnerError(l.bucketName(), l.objectName())
+		}
+		return fmt.Errorf("failed to update object: %w", err)
+	}
+	l.recordWrite(w, nbf)
+
+	return nil
+}
+
+// AcquireOrExtend renews the lease if this process still holds the lock, and
+// otherwise attempts to acquire it. The renewal is conditional on the lock
+// object being unchanged since our last write, so it cannot extend a lock that
+// another process has since taken. If the lock is held by another process, it
+// returns a [*LockHeldError].
+func (l *Lock) AcquireOrExtend(ctx context.Context, ttl time.Duration) error {
+	ctx = l.resolveContext(ctx)
+
+	if generation, _ := l.LastGeneration(); generation != 0 {
+		err := l.Renew(ctx, ttl)
+		if err == nil {
+			return nil
+		}
+
+		var ownerErr *NotLockOwnerError
+		if !errors.As(err, &ownerErr) {
+			return err
+		}
+	}
+
+	return l.Acquire(ctx, ttl)
+}
+
+// ForceAcquire takes the lock by writing the lock object unconditionally,
+// without the preconditions that [Lock.Acquire] uses to detect competing
+// writers. It still reads the object first and returns a [*LockHeldError] if
+// the lock is held, unless the lock was created with [WithForce], in which case
+// it skips the read and overwrites even a live lock. With [WithDryRun], it never
+// writes the lock object.
+//
+// WARNING: ForceAcquire can break mutual exclusion. Two processes that force at
+// the same time may both believe they hold the lock, and forcing over a live
+// lock steals it from its holder. It is intended only for operator recovery of
+// abandoned locks.
+func (l *Lock) ForceAcquire(ctx context.Context, ttl time.Duration) error {
+	ctx = l.resolveContext(ctx)
+
+	if l.state.draining.Load() {
+		return fmt.Errorf("failed to force acquire lock: %w", ErrDraining)
+	}
+	if err := l.validateTTL(ttl); err != nil {
+		return fmt.Errorf("failed to force acquire lock: %w", err)
+	}
+
+	now := l.now()
+	if err := l.resolveObject(now); err != nil {
+		return fmt.Errorf("failed to force acquire lock: %w", err)
+	}
+	nbf := l.notBefore(now, ttl)
+
+	if !l.force {
+		info, err := l.readInfo(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to force acquire lock: %w", err)
+		}
+		info = l.skewedInfo(info)
+		if info.HeldAt(now) {
+			l.state.stats.heldRejections.Add(1)
+			return fmt.Errorf("failed to force acquire lock: %w", newLockHeldErrorFromInfo(info))
+		}
+	}
+
+	if l.dryRun {
+		return nil
+	}
+
+	opCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	objHandle := l.objectHandle()
+	w := l.newWriter(opCtx, objHandle, nbf, newToken())
+	if err := l.closeWriter(w, nbf); err != nil {
+		return fmt.Errorf("failed to force acquire lock: %w", err)
+	}
+	l.recordWrite(w, nbf)
+	l.state.stats.acquires.Add(1)
+
+	return nil
+}
+
+// Release deletes the lock object so that other processes can acquire it
+// immediately, but only if the lock object has not been modified since our
+// last write and still carries the random token from our acquisition. If
+// another process has since taken the lock, it returns a [*NotLockOwnerError].
+// If the object was already deleted, it returns nil.
+func (l *Lock) Release(ctx context.Context) error {
+	ctx = l.resolveContext(ctx)
+
+	generation, _ := l.LastGeneration()
+	if generation == 0 {
+		return fmt.Errorf("failed to release lock: %w", NewNotLockOwnerError(l.bucketName(), l.objectName()))
+	}
+	if err := l.verifyOwner(ctx, generation); err != nil {
+		return fmt.Errorf("failed to release lock: %w", err)
+	}
+
+	opCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	objHandle := l.objectHandle()
+	if err := objHandle.If(storage.Conditions{
+		GenerationMatch: generation,
+	}).Delete(l.requestContext(opCtx)); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		if isPreconditionFailed(err) {
+			l.setLastGeneration(0, 0, "")
+			return fmt.Errorf("failed to release lock: %w", NewNotLockOwnerError(l.bucketName(), l.objectName()))
+		}
+		return fmt.Errorf("failed to release lock: %w", err)
+	}
+	l.setLastGeneration(0, 0, "")
+	l.state.stats.releases.Add(1)
+
+	return nil
+}
+
+// Refresh re-reads the generation and metageneration of the lock object and
+// caches them for use as preconditions by later calls to [Lock.Renew] and
+// [Lock.Release], without modifying the object. This recovers from situations
+// where a write succeeded but the response was lost, leaving the cached values
+// stale.
+//
+// Refresh cannot tell whether the object was last written by this process, so
+// it should only be called by a process that believes it holds the lock. If
+// the object no longer exists, the cached values are cleared and it returns
+// [ErrLockGone].
+func (l *Lock) Refresh(ctx context.Context) error {
+	ctx = l.resolveContext(ctx)
+
+	opCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	attrs, err := l.objectHandle().Attrs(opCtx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			l.setLastGeneration(0, 0, "")
+			return fmt.Errorf("failed to refresh lock: %w", ErrLockGone)
+		}
+		return fmt.Errorf("failed to refresh lock: %w", err)
+	}
+	l.setLastGeneration(attrs.Generation, attrs.Metageneration, attrs.Metadata[tokenKey])
+	if nbf, err := parseNotBefore(attrs); err == nil {
+		l.setLastNotBefore(time.Unix(nbf, 0).UTC())
+	}
+	l.setLastAcquiredAt(attrs.Metadata[acquiredAtKey])
+
+	return nil
+}
+
+// validateTTL checks that the requested ttl is allowed by the configuration.
+// Because timestamps are stored with second granularity, a ttl below one
+// second would produce a lock that is already expired.
+func (l *Lock) validateTTL(ttl time.Duration) error {
+	if ttl < time.Second {
+		return fmt.Errorf("ttl %s must be at least 1s", ttl)
+	}
+	if l.maxTTL > 0 && ttl > l.maxTTL {
+		return fmt.Errorf("ttl %s exceeds maximum of %s", ttl, l.maxTTL)
+	}
+	return nil
+}
+
+// clampTTL shortens the ttl so that now+ttl does not extend beyond the
+// deadline on the context, if any. It returns an error if the deadline has
+// already passed.
+func clampTTL(ctx context.Context, now time.Time, ttl time.Duration) (time.Duration, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ttl, nil
+	}
+
+	if !deadline.After(now) {
+		return 0, fmt.Errorf("context deadline %s is in the past", deadline.UTC().Format(time.RFC3339))
+	}
+
+	if remaining := deadline.Sub(now); remaining < ttl {
+		return remaining, nil
+	}
+	return ttl, nil
+}
+
+// CloseAndRelease is like [Lock.Close], but it first makes a best-effort
+// attempt to release the lock, for convenient deferred cleanup in programs that
+// hold a single lock. A lock that is not held by this process is not an error.
+// Errors from releasing and closing are combined. Use [Lock.Close] instead if
+// the lock should remain held after shutdown.
+func (l *Lock) CloseAndRelease(ctx context.Context) error {
+	ctx = l.resolveContext(ctx)
+
+	l.state.mu.Lock()
+	closed := l.state.closed
+	l.state.mu.Unlock()
+	if closed {
+		return nil
+	}
+
+	var releaseErr error
+	if err := l.Release(ctx); err != nil && !errors.Is(err, new(NotLockOwnerError)) {
+		releaseErr = err
+	}
+	return errors.Join(releaseErr, l.Close(ctx))
+}
+
+// Close terminates the client connection. It does not delete the lock. If the
+// lock shares its client with other locks, such as the locks in a [LockSet],
+// Close does nothing. It is safe to call Close more than once; calls after the
+// first return nil.
+func (l *Lock) Close(_ context.Context) error {
+	if !l.ownsClient {
+		return nil
+	}
+
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+
+	if l.state.closed {
+		return nil
+	}
+	l.state.closed = true
+
+	if err := l.client.Close(); err != nil {
+		return fmt.Errorf("failed to close storage client: %w", err)
+	}
+	return nil
+}
+
+// tryAcquire is the internal implementation of [Acquire] that actually creates
+// and updates the lock. If the lock is available at now, it writes nbf and
+// returns the lease written to the object. If pred is not nil, an existing lock
+// object is only replaced if pred returns true for it. The ownership token of
+// the write is token, and if the object already carries it, an earlier attempt
+// of the same write succeeded and its lease is adopted.
+func (l *Lock) tryAcquire(ctx context.Context, now, nbf time.Time, pred func(LockInfo) bool, token string) (*Lease, error) {
+	now = now.Truncate(time.Second)
+	objHandle := l.objectHandle()
+
+	// Optimistically create the object. Only if it already exists do we need to
+	// read it to decide whether the lock is held.
+	if l.skipPreRead && !l.dryRun {
+		lease, err := l.writeLease(ctx, objHandle.If(storage.Conditions{DoesNotExist: true}), nbf, token)
+		if err == nil || !isPreconditionFailed(err) {
+			return lease, err
+		}
+	}
+
+	// Try to get the attributes on the object.
+	attrsCtx, cancel := l.operationContext(ctx)
+	attrs, err := objHandle.Attrs(attrsCtx)
+	cancel()
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		if isPermissionDenied(err) {
+			return nil, NewPermissionDeniedError(l.bucketName(), l.objectName(), err)
+		}
+		if rerr := retryThrottled(ctx, err); rerr != nil {
+			return nil, rerr
+		}
+		return nil, fmt.Errorf("failed to get storage object: %w", err)
+	}
+
+	// Refuse to overwrite objects that do not look like our locks.
+	if attrs != nil && l.strictMetadata {
+		if _, ok := attrs.Metadata[notBeforeKey]; !ok {
+			return nil, NewCorruptLockError(l.bucketName(), l.objectName(), "missing nbf metadata")
+		}
+		if _, err := parseNotBefore(attrs); err != nil {
+			return nil, NewCorruptLockError(l.bucketName(), l.objectName(), err.Error())
+		}
+	}
+
+	// An earlier attempt of this write succeeded, but its response was lost.
+	if attrs != nil && attrs.Metadata[tokenKey] == token && !l.dryRun {
+		return l.adoptWrite(attrs, nbf), nil
+	}
+
+	// If we found the object, check if the lock is valid and held.
+	if attrs != nil && attrs.Metadata != nil {
+		info, err := ParseLockInfo(attrs)
+		if err != nil {
+			return nil, err
+		}
+		stored := info.clone()
+
+		info = l.skewedInfo(info)
+
+		// Reserve the lock for its previous owner during the sticky grace period.
+		if l.stickyGrace > 0 && info.Owner != "" && info.Owner != l.owner {
+			info.NotBefore = info.NotBefore.Add((l.stickyGrace + time.Second - 1).Truncate(time.Second))
+		}
+
+		if info.HeldAt(now) {
+			lockErr := newLockHeldErrorFromInfo(info)
+			lockErr.info = stored
+			return nil, lockErr
+		}
+
+		if pred != nil && !pred(*stored.clone()) {
+			return nil, NewPredicateFailedError(l.bucketName(), l.objectName(), stored)
+		}
+	}
+
+	// If we got this far, it means the lock object either does not exist, or it
+	// exists but is past the TTL. Therefore we need to create/update the file,
+	// taking into account the possibility that competing processes are fighting
+	// for the lock.
+
+	// If generation and metageneration are 0, then we should only create the
+	// object if it does not exist. Otherwise, we should only perform an update if
+	// the metagenerations match.
+	var conds storage.Conditions
+	if attrs == nil {
+		// The object did not exist, so ensure it does not exist when we write.
+		conds = storage.Conditions{
+			DoesNotExist: true,
+		}
+	} else {
+		// The object exists, so set metadata to ensure we catch a race.
+		conds = storage.Conditions{
+			GenerationMatch:     attrs.Generation,
+			MetagenerationMatch: attrs.Metageneration,
+		}
+	}
+
+	// In dry-run mode, stop before writing. A missing bucket would otherwise
+	// only be detected by the write.
+	if l.dryRun {
+		if attrs == nil {
+			bucketCtx, cancel := l.operationContext(ctx)
+			defer cancel()
+
+			if _, err := l.client.Bucket(l.bucketName()).Attrs(bucketCtx); err != nil {
+				if errors.Is(err, storage.ErrBucketNotExist) {
+					return nil, NewBucketNotFoundError(l.bucketName())
+				}
+				return nil, fmt.Errorf("failed to get storage bucket: %w", err)
+			}
+		}
+		return &Lease{NotBefore: nbf}, nil
+	}
+
+	return l.writeLease(ctx, objHandle.If(conds), nbf, token)
+}
+
+// skewedInfo returns a copy of info whose expiration is extended by the
+// [WithClockSkew] margin, to allow for the clocks of other processes being
+// behind ours.
+func (l *Lock) skewedInfo(info *LockInfo) *LockInfo {
+	info = info.clone()
+	if l.clockSkew > 0 {
+		info.NotBefore = info.NotBefore.Add((l.clockSkew + time.Second - 1).Truncate(time.Second))
+	}
+	return info
+}
+
+// adoptWrite records the lease in attrs, which an earlier attempt of the
+// current write stored, as if the write had just succeeded.
+func (l *Lock) adoptWrite(attrs *storage.ObjectAttrs, nbf time.Time) *Lease {
+	l.setLastGeneration(attrs.Generation, attrs.Metageneration, attrs.Metadata[tokenKey])
+	l.setLastNotBefore(nbf)
+	l.setLastAcquiredAt(attrs.Metadata[acquiredAtKey])
+
+	return &Lease{
+		NotBefore:      nbf,
+		Generation:     attrs.Generation,
+		Metageneration: attrs.Metageneration,
+	}
+}
+
+// writeLease writes the given not-before time to the lock object, subject to
+// the conditions on objHandle, and returns the lease written. Failed
+// preconditions are retryable.
+func (l *Lock) writeLease(ctx context.Context, objHandle *storage.ObjectHandle, nbf time.Time, token string) (*Lease, error) {
+	writeCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	w := l.newWriter(writeCtx, objHandle, nbf, token)
+
+	// Write the metadata back to the object.
+	if err := l.closeWriter(w, nbf); err != nil {
+		return nil, l.writeError(ctx, w.PredefinedACL, err)
+	}
+
+	// Record the write before verifying it, so that a write that cannot be
+	// verified can still be undone.
+	l.recordWrite(w, nbf)
+	if l.verifyAfterWrite {
+		if err := l.verifyWrite(ctx, w.Attrs().Generation, nbf); err != nil {
+			l.undoWrite(ctx, w.Attrs().Generation)
+			return nil, err
+		}
+	}
+
+	return &Lease{
+		NotBefore:      nbf,
+		Generation:     w.Attrs().Generation,
+		Metageneration: w.Attrs().Metageneration,
+	}, nil
+}
+
+// writeError classifies an error from writing a lease with the given object
+// ACL, making it retryable if writing again may succeed.
+func (l *Lock) writeError(ctx context.Context, acl string, err error) error {
+	// Over gRPC, the conflict is reported as a failed precondition, so it must
+	// be told apart from contention first.
+	if l.isUniformAccessConflict(ctx, acl, err) {
+		return NewConfigurationError(l.bucketName(), l.objectName(),
+			"the bucket has uniform bucket-level access enabled, which is incompatible with object ACLs "+
+				"such as WithPredefinedACL", err)
+	}
+
+	// The object was deleted or modified between when we read attributes and
+	// now.
+	if isNotFoundOrPreconditionFailed(err) {
+		// A missing bucket also returns a 404, but retrying will not help.
+		if !isPreconditionFailed(err) {
+			bucketCtx, cancel := l.operationContext(ctx)
+			defer cancel()
+
+			if _, berr := l.client.Bucket(l.bucketName()).Attrs(bucketCtx); errors.Is(berr, storage.ErrBucketNotExist) {
+				return NewBucketNotFoundError(l.bucketName())
+			}
+		}
+		return retry.RetryableError(err)
+	}
+
+	// The upload was corrupted in transit. Writing again recomputes the
+	// checksum, so it is safe to retry.
+	if isChecksumMismatch(err) {
+		return retry.RetryableError(err)
+	}
+
+	if isPermissionDenied(err) {
+		return NewPermissionDeniedError(l.bucketName(), l.objectName(), err)
+	}
+
+	if rerr := retryThrottled(ctx, err); rerr != nil {
+		return rerr
+	}
+
+	return fmt.Errorf("failed to update object: %w", err)
+}
+
+// verifyWrite re-reads the lock object and returns a retryable error unless it
+// is still at the given generation with the given not-before time.
+func (l *Lock) verifyWrite(ctx context.Context, generation int64, nbf time.Time) error {
+	opCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	attrs, err := l.objectHandle().Attrs(opCtx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return retry.RetryableError(fmt.Errorf("failed to verify write: object no longer exists"))
+		}
+
+		// The write itself succeeded, so a failed read is retried like a
+		// mismatch once the write has been undone.
+		return retry.RetryableError(fmt.Errorf("failed to verify write: %w", err))
+	}
+
+	if attrs.Generation != generation {
+		return retry.RetryableError(fmt.Errorf("failed to verify write: generation %d does not match %d",
+			attrs.Generation, generation))
+	}
+	if got, err := parseNotBefore(attrs); err != nil || got != nbf.Unix() {
+		return retry.RetryableError(fmt.Errorf("failed to verify write: nbf %q does not match %q",
+			attrs.Metadata[notBeforeKey], l.formatNotBefore(nbf)))
+	}
+	return nil
+}
+
+// undoWrite deletes the lock object if it is still at the given generation,
+// which this process just wrote but could not verify. The lease state is only
+// discarded once the object is known not to be ours, so that [Lock.Release]
+// can still clean up if the delete fails.
+func (l *Lock) undoWrite(ctx context.Context, generation int64) {
+	// The verification may have failed because the context was cancelled, so
+	// detach from it.
+	opCtx, cancel := l.operationContext(context.WithoutCancel(ctx))
+	defer cancel()
+
+	err := l.objectHandle().If(storage.Conditions{
+		GenerationMatch: generation,
+	}).Delete(l.requestContext(opCtx))
+	if err == nil || errors.Is(err, storage.ErrObjectNotExist) || isPreconditionFailed(err) {
+		l.setLastGeneration(0, 0, "")
+	}
+}
+
+// retry calls f according to a new instance of the retry policy, notifying the
+// [WithOnRetry] callback before each retry.
+func (l *Lock) retry(ctx context.Context, f retry.RetryFunc) error {
+	policy := l.retryPolicy()
+
+	var attempt int
+	var lastErr error
+	backoff := retry.BackoffFunc(func() (time.Duration, bool) {
+		next, stop := policy.Next()
+		if !stop {
+			l.state.stats.retries.Add(1)
+			if l.onRetry != nil {
+				l.onRetry(attempt, lastErr)
+			}
+		}
+		return next, stop
+	})
+
+	return retry.Do(ctx, backoff, func(ctx context.Context) error {
+		attempt++
+		err := f(ctx)
+
+		// The backoff is only consulted for retryable errors, so unwrap the
+		// retryable marker to report the underlying error.
+		lastErr = errors.Unwrap(err)
+		return err
+	})
+}
+
+// createBucket creates the lock bucket. If the bucket already exists because
+// another process created it concurrently, it returns nil.
+func (l *Lock) createBucket(ctx context.Context) error {
+	opCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	if err := l.client.Bucket(l.bucketName()).Create(opCtx, l.createBucketProject, l.createBucketAttrs); err != nil {
+		// Bucket names are global, so a conflict can also mean that the name is
+		// taken by another project. Only treat it as success if the bucket is
+		// ours, or is at least accessible to us.
+		var googleErr *googleapi.Error
+		if errors.As(err, &googleErr) && googleErr.Code == http.StatusConflict {
+			if hasReason(googleErr, alreadyOwnBucketReason) {
+				return nil
+			}
+			if _, aerr := l.client.Bucket(l.bucketName()).Attrs(opCtx); aerr == nil {
+				return nil
+			}
+			return fmt.Errorf("failed to create storage bucket: bucket name is taken by another project: %w", err)
+		}
+		return fmt.Errorf("failed to create storage bucket: %w", err)
+	}
+	return nil
+}
+
+// notBefore computes the expiration of a lease of the given ttl starting at
+// now. By default both values are truncated to the second, which can shorten
+// the lease by up to a second. With [WithTTLRoundUp], the exact expiration is
+// rounded up to the next second instead.
+func (l *Lock) notBefore(now time.Time, ttl time.Duration) time.Time {
+	if l.ttlRoundUp {
+		nbf := now.Add(ttl)
+		if truncated := nbf.Truncate(time.Second); !truncated.Equal(nbf) {
+			return truncated.Add(time.Second)
+		}
+		return nbf
+	}
+	return now.Truncate(time.Second).Add(ttl.Truncate(time.Second))
+}
+
+// newWriter creates a writer for the lock object that stores the given
+// not-before time and ownership token in the metadata.
+func (l *Lock) newWriter(ctx context.Context, objHandle *storage.ObjectHandle, nbf time.Time, token string) *storage.Writer {
+	// With an idempotency key, the ownership token doubles as the nonce of the
+	// idempotency token. Callers pass the same token when they re-issue a
+	// write, so that it can be deduplicated, and a new one for every other
+	// write, so that no two writes share an idempotency token.
+	ctx = l.requestContext(ctx)
+	if l.idempotencyKey != "" {
+		ctx = withIdempotencyTokenContext(ctx, l.idempotencyKey+"-"+token)
+	}
+
+	w := objHandle.NewWriter(ctx)
+	w.CacheControl = l.cacheControl
+	w.ChunkSize = l.chunkSize
+	w.SendCRC32C = true
+	w.KMSKeyName = l.kmsKeyName
+	w.StorageClass = l.storageClass
+	w.PredefinedACL = l.predefinedACL
+	if l.disableCompression {
+		// Store the object verbatim, and ask intermediaries not to transform it,
+		// so that the CRC32C matches what we sent.
+		w.ContentEncoding = "identity"
+		w.ContentType = "application/octet-stream"
+		if !strings.Contains(w.CacheControl, "no-transform") {
+			w.CacheControl = strings.TrimPrefix(w.CacheControl+", no-transform", ", ")
+		}
+	}
+	if w.Metadata == nil {
+		w.Metadata = make(map[string]string, len(l.metadata)+1)
+	}
+	for k, v := range l.metadata {
+		w.Metadata[k] = v
+	}
+	w.Metadata[notBeforeKey] = l.formatNotBefore(nbf)
+	w.Metadata[tokenKey] = token
+	if l.trackAcquiredAt {
+		w.Metadata[acquiredAtKey] = strconv.FormatInt(l.now().Unix(), 10)
+	}
+	if l.autoDelete {
+		w.CustomTime = nbf.Add(l.autoDeleteAfter)
+	}
+	if l.owner != "" {
+		w.Metadata[ownerKey] = l.owner
+	}
+	return w
+}
+
+// closeWriter writes the optional [WithBodyWriter] body and closes the writer,
+// committing the object. If the body cannot be rendered, nothing is written.
+func (l *Lock) closeWriter(w *storage.Writer, nbf time.Time) error {
+	if l.bodyWriter != nil {
+		metadata := make(map[string]string, len(w.Metadata))
+		for k, v := range w.Metadata {
+			if !isReservedMetadataKey(k) {
+				metadata[k] = v
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := l.bodyWriter(&buf, LockInfo{
+			Object:    w.ObjectAttrs.Name,
+			NotBefore: nbf,
+			Owner:     w.Metadata[ownerKey],
+			Metadata:  metadata,
+		}); err != nil {
+			return fmt.Errorf("failed to write lock body: %w", err)
+		}
+
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			_ = w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// bucketName returns the name of the current bucket.
+func (l *Lock) bucketName() string {
+	if l.fallbackBucket == "" {
+		return l.bucket
+	}
+
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	if l.state.fallback {
+		return l.fallbackBucket
+	}
+	return l.bucket
+}
+
+// useFallbackBucket switches between the primary and fallback buckets. If the
+// bucket changes, the lease state for the previous bucket is discarded.
+func (l *Lock) useFallbackBucket(fallback bool) {
+	if l.fallbackBucket == "" {
+		return
+	}
+
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	if fallback != l.state.fallback {
+		l.state.fallback = fallback
+		l.state.generation = 0
+		l.state.metageneration = 0
+		l.state.token = ""
+		l.state.notBefore = time.Time{}
+		l.state.cachedInfo = nil
+	}
+}
+
+// objectName returns the name of the current lock object.
+func (l *Lock) objectName() string {
+	if l.objectTemplate == nil {
+		return l.object
+	}
+
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	if l.state.object == "" {
+		return l.objectTemplate(l.now())
+	}
+	return l.state.object
+}
+
+// resolveObject evaluates the object template, if any, at the given time. If
+// the result differs from the current object, it becomes the current object and
+// the lease state for the previous object is discarded.
+func (l *Lock) resolveObject(now time.Time) error {
+	if l.objectTemplate == nil {
+		return nil
+	}
+
+	object := l.objectTemplate(now)
+	if err := validateObjectName(object); err != nil {
+		return fmt.Errorf("invalid object from template: %w", err)
+	}
+
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	if object != l.state.object {
+		l.state.object = object
+		l.state.generation = 0
+		l.state.metageneration = 0
+		l.state.token = ""
+		l.state.notBefore = time.Time{}
+		l.state.cachedInfo = nil
+	}
+	return nil
+}
+
+// objectHandle returns a handle to the lock object, configured with the storage
+// retry options from [WithStorageRetry].
+func (l *Lock) objectHandle() *storage.ObjectHandle {
+	objHandle := l.client.Bucket(l.bucketName()).Object(l.objectName())
+	if len(l.storageRetryOpts) > 0 {
+		objHandle = objHandle.Retryer(l.storageRetryOpts...)
+	}
+	return objHandle
+}
+
+// formatNotBefore formats the not-before time for storage in the metadata.
+func (l *Lock) formatNotBefore(nbf time.Time) string {
+	if l.rfc3339Timestamps {
+		return nbf.UTC().Format(time.RFC3339)
+	}
+	return strconv.FormatInt(nbf.Unix(), 10)
+}
+
+// now returns the current time in UTC.
+func (l *Lock) now() time.Time {
+	return l.nowFunc().UTC()
+}
+
+// withObject returns a new lock for a different object in the same bucket. It
+// shares the storage client and configuration of l, but has its own lease
+// state and does not close the client.
+func (l *Lock) withObject(object string) *Lock {
+	clone := *l
+	clone.object = object
+	clone.objectTemplate = nil
+	clone.ownsClient = false
+	clone.state = new(lockState)
+	return &clone
+}
+
+// operationContext returns a context for a single upstream API call. If an
+// operation timeout is configured, the call is bounded by it in addition to
+// any deadline on ctx.
+func (l *Lock) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if l.operationTimeout > 0 {
+		return context.WithTimeout(ctx, l.operationTimeout)
+	}
+	return ctx, func() {}
+}
+
+// requestContext returns a context that attaches the configured request
+// headers to upstream API calls. It is used for every write to the lock object.
+func (l *Lock) requestContext(ctx context.Context) context.Context {
+	if l.requestReason != "" {
+		ctx = callctx.SetHeaders(ctx, requestReasonHeader, l.requestReason)
+	}
+	return ctx
+}
+
+// LastGeneration returns the generation and metageneration of the lock object
+// from the most recent successful write by this process, or zeros if this
+// process does not hold a lease. Callers can use these values as preconditions
+// for their own conditional writes or deletes on the lock object:
+//
+//	generation, _ := lock.LastGeneration()
+//	obj := client.Bucket(bucket).Object(object)
+//	err := obj.If(storage.Conditions{GenerationMatch: generation}).Delete(ctx)
+func (l *Lock) LastGeneration() (generation, metageneration int64) {
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	return l.state.generation, l.state.metageneration
+}
+
+// lastToken returns the ownership token from our most recent write.
+func (l *Lock) lastToken() string {
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	return l.state.token
+}
+
+// verifyOwner reads the lock object and returns a [*NotLockOwnerError] if it
+// exists but is not at the given generation or does not carry our ownership
+// token. This catches the same lock being reused for two acquisitions, which a
+// generation precondition alone can miss. If the object does not exist, it
+// returns nil and leaves the outcome to the caller's conditional request.
+func (l *Lock) verifyOwner(ctx context.Context, generation int64) error {
+	token := l.lastToken()
+	if token == "" {
+		return nil
+	}
+
+	opCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	attrs, err := l.objectHandle().Attrs(opCtx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to get storage object: %w", err)
+	}
+
+	if attrs.Generation != generation || attrs.Metadata[tokenKey] != token {
+		l.setLastGeneration(0, 0, "")
+		return NewNotLockOwnerError(l.bucketName(), l.objectName())
+	}
+	return nil
+}
+
+// recordWrite records the lease from a successful write of the lock object
+// with the given not-before time.
+func (l *Lock) recordWrite(w *storage.Writer, nbf time.Time) {
+	l.setLastGeneration(w.Attrs().Generation, w.Attrs().Metageneration, w.Metadata[tokenKey])
+	l.setLastNotBefore(nbf)
+	l.setLastAcquiredAt(w.Metadata[acquiredAtKey])
+}
+
+// setLastAcquiredAt records the acquired_at value from our most recent write.
+func (l *Lock) setLastAcquiredAt(acquiredAt string) {
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	l.state.acquiredAt = acquiredAt
+}
+
+// lastAcquiredAt returns the acquired_at value from our most recent write, or
+// the empty string if none was recorded.
+func (l *Lock) lastAcquiredAt() string {
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	return l.state.acquiredAt
+}
+
+// setLastNotBefore records the not-before time from our most recent write.
+func (l *Lock) setLastNotBefore(nbf time.Time) {
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	l.state.notBefore = nbf
+}
+
+// lastNotBefore returns the not-before time from our most recent write, or the
+// zero time if this process does not hold a lease.
+func (l *Lock) lastNotBefore() time.Time {
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	return l.state.notBefore
+}
+
+// Reset forgets the generation, metageneration, and ownership token from our
+// most recent write, along with any cached lock info, so that the next
+// operation starts fresh from a full read. This is an escape hatch for when an
+// external process has modified the lock object. Afterwards, this process no
+// longer holds the lease; use [Lock.Refresh] to adopt the current object
+// instead. It is safe for concurrent use.
+func (l *Lock) Reset() {
+	l.setLastGeneration(0, 0, "")
+}
+
+// setLastGeneration records the generation, metageneration, and ownership
+// token of the lock object from our most recent write.
+func (l *Lock) setLastGeneration(generation, metageneration int64, token string) {
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	l.state.generation = generation
+	l.state.metageneration = metageneration
+	l.state.token = token
+	l.state.notBefore = time.Time{}
+	l.state.acquiredAt = ""
+
+	// Every write by this process records its generation here, so this is also
+	// where the cached state is invalidated.
+	l.state.cachedInfo = nil
+}
+
+// retryThrottled returns a retryable error if the upstream API error indicates
+// the request was rate limited (429) or the service is unavailable (503), and
+// nil otherwise. If the response included a Retry-After header, it first
+// sleeps for that long. If the context is done while sleeping, it returns the
+// context error.
+func retryThrottled(ctx context.Context, err error) error {
+	var googleErr *googleapi.Error
+	if !errors.As(err, &googleErr) {
+		// The gRPC transport returns status errors instead, which do not carry a
+		// Retry-After header.
+		switch status.Code(err) {
+		case codes.ResourceExhausted, codes.Unavailable:
+			return retry.RetryableError(err)
+		}
+		return nil
+	}
+
+	switch googleErr.Code {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+	default:
+		return nil
+	}
+
+	if wait := parseRetryAfter(googleErr.Header.Get("Retry-After"), time.Now()); wait > 0 {
+		if serr := sleep(ctx, wait); serr != nil {
+			return serr
+		}
+	}
+	return retry.RetryableError(err)
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date. It returns zero if the value is empty or
+// invalid.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// sleep waits for the given duration, returning the context error if the
+// context is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isReservedMetadataKey returns true if the metadata key is used by gcslock to
+// store lock state.
+func isReservedMetadataKey(k string) bool {
+	return k == notBeforeKey || k == ownerKey || k == tokenKey || k == acquiredAtKey
+}
+
+// isNotFoundOrPreconditionFailed returns true if the error is an upstream API
+// error indicating the object does not exist or did not match the write
+// preconditions.
+func isNotFoundOrPreconditionFailed(err error) bool {
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return googleErr.Code == http.StatusNotFound || googleErr.Code == http.StatusPreconditionFailed
+	}
+	return status.Code(err) == codes.NotFound || isPreconditionFailed(err)
+}
+
+// newToken returns a random ownership token.
+func newToken() string {
+	b := make([]byte, 8)
+
+	// This only fails if the system's randomness source is broken, in which case
+	// the generation precondition still protects the lock.
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isUnavailable returns true if the upstream API error indicates the service is
+// unavailable, from either the JSON or the gRPC transport.
+func isUnavailable(err error) bool {
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return googleErr.Code == http.StatusServiceUnavailable
+	}
+	return status.Code(err) == codes.Unavailable
+}
+
+// isChecksumMismatch returns true if the upstream API rejected an upload
+// because the CRC32C sent with it did not match the data received, from either
+// the JSON or the gRPC transport. Other invalid requests, such as a bad KMS key
+// or storage class, are not retryable and must not match.
+func isChecksumMismatch(err error) bool {
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		if googleErr.Code != http.StatusBadRequest {
+			return false
+		}
+		if isChecksumMessage(googleErr.Message) {
+			return true
+		}
+		for _, item := range googleErr.Errors {
+			if isChecksumMessage(item.Message) {
+				return true
+			}
+		}
+		return false
+	}
+	if s, ok := status.FromError(err); ok {
+		return s.Code() == codes.InvalidArgument && isChecksumMessage(s.Message())
+	}
+	return false
+}
+
+// isChecksumMessage returns true if the upstream API error message is about a
+// checksum of the uploaded data.
+func isChecksumMessage(msg string) bool {
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "crc32c") || strings.Contains(msg, "checksum")
+}
+
+// isUniformAccessConflict returns true if a write that set the given object ACL
+// was rejected because the bucket has uniform bucket-level access, from either
+// the JSON or the gRPC transport. The rejection itself only says that the
+// request was invalid or that a precondition failed, so the bucket is read to
+// confirm.
+func (l *Lock) isUniformAccessConflict(ctx context.Context, acl string, err error) bool {
+	if acl == "" {
+		return false
+	}
+
+	var googleErr *googleapi.Error
+	switch {
+	case errors.As(err, &googleErr):
+		invalid := googleErr.Code == http.StatusBadRequest && hasReason(googleErr, invalidReason)
+		if !invalid && googleErr.Code != http.StatusPreconditionFailed {
+			return false
+		}
+	case status.Code(err) != codes.InvalidArgument && status.Code(err) != codes.FailedPrecondition:
+		return false
+	}
+
+	bucketCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	attrs, berr := l.client.Bucket(l.bucketName()).Attrs(bucketCtx)
+	if berr != nil {
+		return false
+	}
+	return attrs.UniformBucketLevelAccess.Enabled
+}
+
+// hasReason returns true if any of the error details of the JSON API error
+// carry the given reason.
+func hasReason(googleErr *googleapi.Error, reason string) bool {
+	for _, item := range googleErr.Errors {
+		if item.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// isPermissionDenied returns true if the upstream API error indicates the
+// caller is not authorized, from either the JSON or the gRPC transport.
+func isPermissionDenied(err error) bool {
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return googleErr.Code == http.StatusForbidden
+	}
+	return status.Code(err) == codes.PermissionDenied
+}
+
+// isPreconditionFailed returns true if the upstream API error indicates a
+// precondition failure, from either the JSON or the gRPC transport.
+func isPreconditionFailed(err error) bool {
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return googleErr.Code == http.StatusPreconditionFailed
+	}
+	return status.Code(err) == codes.FailedPrecondition
 }
@@ -15,13 +15,31 @@
 package gcslock
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/storage"
 	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/googleapis/gax-go/v2/callctx"
+	"github.com/sethvargo/go-retry"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestLockHeldError_Error(t *testing.T) {
@@ -90,6 +108,91 @@ func TestLockHeldError_NotBefore(t *testing.T) {
 	}
 }
 
+func TestLockHeldError_MarshalJSON(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		err  *LockHeldError
+		exp  string
+	}{
+		{
+			name: "no_owner",
+			err:  NewLockHeldError(1902902494),
+			exp:  `{"error":"lock_held","not_before":"2030-04-20T08:01:34Z","owner":""}`,
+		},
+		{
+			name: "owner",
+			err:  &LockHeldError{nbf: 1902902494, owner: "pod-1"},
+			exp:  `{"error":"lock_held","not_before":"2030-04-20T08:01:34Z","owner":"pod-1"}`,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			b, err := json.Marshal(tc.err)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(b), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLockHeldError_Is(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		err    error
+		target error
+		exp    bool
+	}{
+		{
+			name:   "sentinel",
+			err:    NewLockHeldError(0),
+			target: ErrLockHeld,
+			exp:    true,
+		},
+		{
+			name:   "wrapped_sentinel",
+			err:    fmt.Errorf("failed to acquire lock: %w", NewLockHeldError(0)),
+			target: ErrLockHeld,
+			exp:    true,
+		},
+		{
+			name:   "type",
+			err:    NewLockHeldError(0),
+			target: NewLockHeldError(1902902494),
+			exp:    true,
+		},
+		{
+			name:   "other",
+			err:    NewLockHeldError(0),
+			target: ErrLockGone,
+			exp:    false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := errors.Is(tc.err, tc.target), tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
 func TestNewGCSLock(t *testing.T) {
 	t.Parallel()
 
@@ -114,83 +217,180 @@ func TestNewGCSLock(t *testing.T) {
 	if got, want := lock.object, "object"; got != want {
 		t.Errorf("exected %q to be %q", got, want)
 	}
+	if got, want := lock.Bucket(), "bucket"; got != want {
+		t.Errorf("exected %q to be %q", got, want)
+	}
+	if got, want := lock.Object(), "object"; got != want {
+		t.Errorf("exected %q to be %q", got, want)
+	}
 	if got := lock.retryPolicy; got == nil {
 		t.Errorf("exected retryPolicy to be defined")
 	}
 }
 
-func TestGCSLock_Acquire(t *testing.T) {
+func TestNewWithOptions_grpc(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	lock, err := NewWithOptions(ctx, "bucket", "object", WithGRPC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := lock.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if got := lock.client; got == nil {
+		t.Errorf("exected client to be defined")
+	}
+}
+
+func TestNewWithOptions_conflicts(t *testing.T) {
 	t.Parallel()
 
 	ctx := context.Background()
-	now := time.Unix(1902902494, 0).Truncate(time.Second).UTC()
-	ttl := 5 * time.Minute
 
 	cases := []struct {
-		name        string
-		gcsState    func() *fakestorage.Server
-		expectedNbf time.Time
-		err         string
+		name string
+		opts []Option
+		err  string
 	}{
 		{
-			name: "bucket_no_exist",
-			gcsState: func() *fakestorage.Server {
-				return fakestorage.NewServer(nil)
-			},
-			err: "Not Found",
+			name: "http_client_grpc",
+			opts: []Option{WithHTTPClient(http.DefaultClient), WithGRPC()},
+			err:  "WithHTTPClient is not supported with WithGRPC",
 		},
 		{
-			name: "object_no_exist",
-			gcsState: func() *fakestorage.Server {
-				srv := fakestorage.NewServer(nil)
-				if err := srv.Client().Bucket("my-bucket").Create(ctx, "my-project", nil); err != nil {
-					t.Fatal(err)
-				}
-				return srv
-			},
-			expectedNbf: now.Add(ttl),
+			name: "max_conns_grpc",
+			opts: []Option{WithMaxConnsPerHost(2), WithGRPC()},
+			err:  "WithMaxConnsPerHost is not supported with WithGRPC",
 		},
 		{
-			name: "lock_exists_not_expired",
-			gcsState: func() *fakestorage.Server {
-				srv := fakestorage.NewServer(nil)
-				if err := srv.Client().Bucket("my-bucket").Create(ctx, "my-project", nil); err != nil {
-					t.Fatal(err)
-				}
+			name: "idempotency_key_grpc",
+			opts: []Option{WithIdempotencyKey("my-key"), WithGRPC()},
+			err:  "WithIdempotencyKey is not supported with WithGRPC",
+		},
+		{
+			name: "max_conns_http_client",
+			opts: []Option{WithMaxConnsPerHost(2), WithHTTPClient(http.DefaultClient)},
+			err:  "WithMaxConnsPerHost is not supported with WithHTTPClient",
+		},
+	}
 
-				w := srv.Client().Bucket("my-bucket").Object("my-object").NewWriter(ctx)
-				w.Metadata = map[string]string{
-					notBeforeKey: strconv.FormatInt(now.Add(ttl/2).Unix(), 10),
-				}
+	for _, tc := range cases {
+		tc := tc
 
-				if err := w.Close(); err != nil {
-					t.Fatal(err)
-				}
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
 
-				return srv
-			},
-			err: "lock held until 2030-04-20T08:04:04Z",
-		},
-		{
-			name: "lock_exists_expired",
-			gcsState: func() *fakestorage.Server {
-				srv := fakestorage.NewServer(nil)
-				if err := srv.Client().Bucket("my-bucket").Create(ctx, "my-project", nil); err != nil {
-					t.Fatal(err)
-				}
+			_, err := NewWithOptions(ctx, "my-bucket", "my-object", tc.opts...)
+			checkErr(t, err, tc.err)
+			if !errors.Is(err, new(ConfigurationError)) {
+				t.Errorf("expected %v to be %T", err, new(ConfigurationError))
+			}
+		})
+	}
+}
 
-				w := srv.Client().Bucket("my-bucket").Object("my-object").NewWriter(ctx)
-				w.Metadata = map[string]string{
-					notBeforeKey: strconv.FormatInt(now.Add(-ttl).Unix(), 10),
-				}
+func TestNewWithOptions_endpoint(t *testing.T) {
+	t.Parallel()
 
-				if err := w.Close(); err != nil {
-					t.Fatal(err)
-				}
+	ctx := context.Background()
 
-				return srv
-			},
-			expectedNbf: now.Add(ttl),
+	gcsServer, err := fakestorage.NewServerWithOptions(fakestorage.Options{Scheme: "http"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(gcsServer.Stop)
+	gcsServer.CreateBucketWithOpts(fakestorage.CreateBucketOpts{Name: "my-bucket"})
+
+	lock, err := NewWithOptions(ctx, "my-bucket", "my-object",
+		WithClientOptions(option.WithoutAuthentication()),
+		WithEndpoint(gcsServer.URL()+"/storage/v1/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := lock.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// The lock talks to the fake server only through the endpoint.
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gcsServer.GetObject("my-bucket", "my-object"); err != nil {
+		t.Errorf("expected lock object to exist: %s", err)
+	}
+}
+
+func TestNewWithOptions_maxConnsPerHost(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	_, err := NewWithOptions(ctx, "my-bucket", "my-object", WithMaxConnsPerHost(0))
+	checkErr(t, err, "must be positive")
+
+	gcsServer, err := fakestorage.NewServerWithOptions(fakestorage.Options{Scheme: "http"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(gcsServer.Stop)
+	gcsServer.CreateBucketWithOpts(fakestorage.CreateBucketOpts{Name: "my-bucket"})
+
+	// The client options still apply to the HTTP client built by gcslock.
+	lock, err := NewWithOptions(ctx, "my-bucket", "my-object",
+		WithClientOptions(option.WithoutAuthentication()),
+		WithEndpoint(gcsServer.URL()+"/storage/v1/"),
+		WithMaxConnsPerHost(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := lock.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gcsServer.GetObject("my-bucket", "my-object"); err != nil {
+		t.Errorf("expected lock object to exist: %s", err)
+	}
+}
+
+func TestWithEndpoint(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		endpoint string
+		err      string
+	}{
+		{
+			name:     "valid",
+			endpoint: "https://storage-myendpoint.p.googleapis.com/storage/v1/",
+		},
+		{
+			name:     "no_scheme",
+			endpoint: "storage.googleapis.com",
+			err:      "scheme must be http or https",
+		},
+		{
+			name:     "no_host",
+			endpoint: "https:///storage/v1/",
+			err:      "missing host",
+		},
+		{
+			name:     "unparseable",
+			endpoint: "https://[::1",
+			err:      "invalid endpoint",
 		},
 	}
 
@@ -200,56 +400,4050 @@ func TestGCSLock_Acquire(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
-			gcsServer := tc.gcsState()
-
-			lock, err := New(ctx, "my-bucket", "my-object")
-			if err != nil {
-				t.Fatal(err)
-			}
-			t.Cleanup(func() {
-				if err := lock.Close(ctx); err != nil {
-					t.Fatal(err)
-				}
-			})
+			lock := new(Lock)
+			checkErr(t, WithEndpoint(tc.endpoint)(lock), tc.err)
+		})
+	}
+}
 
-			lock.client = gcsServer.Client()
+func TestGCSLock_ForObject(t *testing.T) {
+	t.Parallel()
 
-			if err := lock.tryAcquire(ctx, now, ttl); err != nil {
-				if tc.err == "" {
-					t.Fatal(err)
-				} else {
-					if got, want := err.Error(), tc.err; !strings.Contains(got, want) {
-						t.Errorf("expected %q to contain %q", got, want)
-					}
-				}
-			} else if tc.err != "" {
-				t.Fatalf("expected error %q, got nothing", tc.err)
-			}
+	ctx := context.Background()
+	ttl := 5 * time.Minute
 
-			if !tc.expectedNbf.IsZero() {
-				attrs, err := gcsServer.Client().
-					Bucket("my-bucket").
-					Object("my-object").
-					Attrs(ctx)
-				if err != nil {
-					t.Fatal(err)
-				}
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer, WithOwner("node-a"))
 
-				if got, want := timeFromUnixString(t, attrs.Metadata[notBeforeKey]), tc.expectedNbf; got != want {
-					t.Errorf("expected %q to be %q", got, want)
-				}
-			}
-		})
+	sibling := lock.ForObject("my-sibling")
+	if got, want := sibling.Object(), "my-sibling"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
 	}
-}
 
-func timeFromUnixString(tb testing.TB, s string) time.Time {
-	tb.Helper()
+	// The locks are independent.
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if err := sibling.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if generation, _ := sibling.LastGeneration(); generation == 0 {
+		t.Errorf("expected sibling to hold its own lease")
+	}
 
-	v, err := strconv.ParseInt(s, 10, 64)
+	info, err := sibling.Info(ctx)
 	if err != nil {
-		tb.Fatal(err)
+		t.Fatal(err)
+	}
+	if got, want := info.Owner, "node-a"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
 	}
 
-	return time.Unix(v, 0).UTC()
+	// The sibling has its own retry budget.
+	retryLock := newTestLock(t, gcsServer,
+		WithRetryJitterPercent(0),
+		WithExponentialBackoff(time.Millisecond, time.Millisecond, 2))
+	retryAttempts(ctx, t, retryLock)
+	if got, want := retryAttempts(ctx, t, retryLock.ForObject("my-sibling")), 3; got != want {
+		t.Errorf("expected %d attempts to be %d", got, want)
+	}
+
+	// Closing the sibling does not close the shared client.
+	if err := sibling.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCSLock_SameTarget(t *testing.T) {
+	t.Parallel()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	cases := []struct {
+		name  string
+		other *Lock
+		exp   bool
+	}{
+		{
+			name:  "self",
+			other: lock,
+			exp:   true,
+		},
+		{
+			name:  "independent",
+			other: newTestLock(t, gcsServer),
+			exp:   true,
+		},
+		{
+			name:  "different_object",
+			other: lock.withObject("other-object"),
+			exp:   false,
+		},
+		{
+			name:  "nil",
+			other: nil,
+			exp:   false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := lock.SameTarget(tc.other), tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_WithDefaultContext(t *testing.T) {
+	t.Parallel()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	withDefault := lock.WithDefaultContext(cancelled)
+
+	// The default context replaces context.TODO and nil.
+	if err := withDefault.Acquire(context.TODO(), time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v to be %v", err, context.Canceled)
+	}
+	if err := withDefault.Acquire(nil, time.Minute); !errors.Is(err, context.Canceled) { //nolint:staticcheck // Testing a nil context.
+		t.Errorf("expected %v to be %v", err, context.Canceled)
+	}
+
+	// Any other context takes precedence.
+	if err := withDefault.Acquire(context.Background(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// The copy shares the lease with the original.
+	if err := lock.Release(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIsNotFoundOrPreconditionFailed(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		err  error
+		exp  bool
+	}{
+		{
+			name: "http_not_found",
+			err:  &googleapi.Error{Code: http.StatusNotFound},
+			exp:  true,
+		},
+		{
+			name: "http_precondition_failed",
+			err:  &googleapi.Error{Code: http.StatusPreconditionFailed},
+			exp:  true,
+		},
+		{
+			name: "http_other",
+			err:  &googleapi.Error{Code: http.StatusForbidden},
+			exp:  false,
+		},
+		{
+			name: "grpc_not_found",
+			err:  status.Error(codes.NotFound, "not found"),
+			exp:  true,
+		},
+		{
+			name: "grpc_precondition_failed",
+			err:  status.Error(codes.FailedPrecondition, "precondition failed"),
+			exp:  true,
+		},
+		{
+			name: "grpc_other",
+			err:  status.Error(codes.PermissionDenied, "denied"),
+			exp:  false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := isNotFoundOrPreconditionFailed(tc.err), tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestIsChecksumMismatch(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		err  error
+		exp  bool
+	}{
+		{
+			name: "http_mismatch",
+			err: &googleapi.Error{
+				Code:    http.StatusBadRequest,
+				Message: `Provided CRC32C "AAAAAA==" doesn't match calculated CRC32C "fT+mOQ==".`,
+				Errors:  []googleapi.ErrorItem{{Reason: "invalid"}},
+			},
+			exp: true,
+		},
+		{
+			name: "http_mismatch_item",
+			err: &googleapi.Error{
+				Code: http.StatusBadRequest,
+				Errors: []googleapi.ErrorItem{{
+					Reason:  "invalid",
+					Message: `Provided CRC32C "AAAAAA==" doesn't match calculated CRC32C "fT+mOQ==".`,
+				}},
+			},
+			exp: true,
+		},
+		{
+			name: "http_other_invalid",
+			err: &googleapi.Error{
+				Code:    http.StatusBadRequest,
+				Message: "Invalid argument.",
+				Errors:  []googleapi.ErrorItem{{Reason: "invalid", Message: "Invalid argument."}},
+			},
+			exp: false,
+		},
+		{
+			name: "http_other_code",
+			err:  &googleapi.Error{Code: http.StatusForbidden, Message: "CRC32C mismatch"},
+			exp:  false,
+		},
+		{
+			name: "grpc_mismatch",
+			err:  status.Error(codes.InvalidArgument, "CRC32C mismatch"),
+			exp:  true,
+		},
+		{
+			name: "grpc_other",
+			err:  status.Error(codes.InvalidArgument, "invalid"),
+			exp:  false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := isChecksumMismatch(tc.err), tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_isUniformAccessConflict(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	invalid := &googleapi.Error{
+		Code:   http.StatusBadRequest,
+		Errors: []googleapi.ErrorItem{{Reason: "invalid"}},
+	}
+
+	cases := []struct {
+		name    string
+		uniform bool
+		acl     string
+		err     error
+		exp     bool
+	}{
+		{
+			name:    "http_conflict",
+			uniform: true,
+			acl:     "projectPrivate",
+			err:     invalid,
+			exp:     true,
+		},
+		{
+			name:    "grpc_conflict",
+			uniform: true,
+			acl:     "projectPrivate",
+			err:     status.Error(codes.FailedPrecondition, "failed precondition"),
+			exp:     true,
+		},
+		{
+			name:    "no_acl",
+			uniform: true,
+			err:     invalid,
+			exp:     false,
+		},
+		{
+			name:    "other_reason",
+			uniform: true,
+			acl:     "projectPrivate",
+			err: &googleapi.Error{
+				Code:   http.StatusBadRequest,
+				Errors: []googleapi.ErrorItem{{Reason: "required"}},
+			},
+			exp: false,
+		},
+		{
+			name: "not_uniform",
+			acl:  "projectPrivate",
+			err:  invalid,
+			exp:  false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			gcsServer := newTestServer(t)
+			lock := newTestLock(t, gcsServer)
+			if tc.uniform {
+				client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{
+					Transport: &uniformAccessTransport{base: gcsServer.HTTPClient().Transport},
+				}))
+				if err != nil {
+					t.Fatal(err)
+				}
+				lock.client = client
+			}
+
+			if got, want := lock.isUniformAccessConflict(ctx, tc.acl, tc.err), tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_Close(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	lock, err := New(ctx, "bucket", "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lock.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Close(ctx); err != nil {
+		t.Errorf("expected second close to succeed, got %s", err)
+	}
+}
+
+func TestGCSLock_CloseAndRelease(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+
+	// Not holding the lock is not an error.
+	if err := newTestLock(t, gcsServer).CloseAndRelease(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	lock := newTestLock(t, gcsServer)
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.CloseAndRelease(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.CloseAndRelease(ctx); err != nil {
+		t.Errorf("expected second close to succeed, got %s", err)
+	}
+
+	if _, err := gcsServer.Client().
+		Bucket("my-bucket").
+		Object("my-object").
+		Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("expected %v to be %v", err, storage.ErrObjectNotExist)
+	}
+}
+
+func TestGCSLock_Acquire(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	now := time.Unix(1902902494, 0).Truncate(time.Second).UTC()
+	ttl := 5 * time.Minute
+
+	cases := []struct {
+		name        string
+		gcsState    func() *fakestorage.Server
+		expectedNbf time.Time
+		err         string
+	}{
+		{
+			name: "bucket_no_exist",
+			gcsState: func() *fakestorage.Server {
+				return fakestorage.NewServer(nil)
+			},
+			err: `bucket "my-bucket" does not exist`,
+		},
+		{
+			name: "object_no_exist",
+			gcsState: func() *fakestorage.Server {
+				srv := fakestorage.NewServer(nil)
+				if err := srv.Client().Bucket("my-bucket").Create(ctx, "my-project", nil); err != nil {
+					t.Fatal(err)
+				}
+				return srv
+			},
+			expectedNbf: now.Add(ttl),
+		},
+		{
+			name: "lock_exists_not_expired",
+			gcsState: func() *fakestorage.Server {
+				srv := fakestorage.NewServer(nil)
+				if err := srv.Client().Bucket("my-bucket").Create(ctx, "my-project", nil); err != nil {
+					t.Fatal(err)
+				}
+
+				w := srv.Client().Bucket("my-bucket").Object("my-object").NewWriter(ctx)
+				w.Metadata = map[string]string{
+					notBeforeKey: strconv.FormatInt(now.Add(ttl/2).Unix(), 10),
+				}
+
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				return srv
+			},
+			err: "lock held until 2030-04-20T08:04:04Z",
+		},
+		{
+			name: "lock_exists_expired",
+			gcsState: func() *fakestorage.Server {
+				srv := fakestorage.NewServer(nil)
+				if err := srv.Client().Bucket("my-bucket").Create(ctx, "my-project", nil); err != nil {
+					t.Fatal(err)
+				}
+
+				w := srv.Client().Bucket("my-bucket").Object("my-object").NewWriter(ctx)
+				w.Metadata = map[string]string{
+					notBeforeKey: strconv.FormatInt(now.Add(-ttl).Unix(), 10),
+				}
+
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				return srv
+			},
+			expectedNbf: now.Add(ttl),
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			gcsServer := tc.gcsState()
+
+			lock, err := New(ctx, "my-bucket", "my-object")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := lock.Close(ctx); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			lock.client = gcsServer.Client()
+
+			lease, err := lock.tryAcquire(ctx, now, lock.notBefore(now, ttl), nil, newToken())
+			if err != nil {
+				if tc.err == "" {
+					t.Fatal(err)
+				} else {
+					if got, want := err.Error(), tc.err; !strings.Contains(got, want) {
+						t.Errorf("expected %q to contain %q", got, want)
+					}
+				}
+			} else if tc.err != "" {
+				t.Fatalf("expected error %q, got nothing", tc.err)
+			}
+
+			if lease != nil {
+				if got, want := lease.NotBefore, tc.expectedNbf; got != want {
+					t.Errorf("expected returned nbf %q to be %q", got, want)
+				}
+				if got, want := lease.Generation, objectGeneration(t, gcsServer); got != want {
+					t.Errorf("expected returned generation %d to be %d", got, want)
+				}
+			}
+
+			if !tc.expectedNbf.IsZero() {
+				attrs, err := gcsServer.Client().
+					Bucket("my-bucket").
+					Object("my-object").
+					Attrs(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got, want := timeFromUnixString(t, attrs.Metadata[notBeforeKey]), tc.expectedNbf; got != want {
+					t.Errorf("expected %q to be %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func timeFromUnixString(tb testing.TB, s string) time.Time {
+	tb.Helper()
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return time.Unix(v, 0).UTC()
+}
+
+func TestClampTTL(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1902902494, 0).UTC()
+	ttl := 5 * time.Minute
+
+	cases := []struct {
+		name     string
+		deadline time.Time
+		exp      time.Duration
+		err      string
+	}{
+		{
+			name: "no_deadline",
+			exp:  ttl,
+		},
+		{
+			name:     "deadline_after_ttl",
+			deadline: now.Add(10 * time.Minute),
+			exp:      ttl,
+		},
+		{
+			name:     "deadline_before_ttl",
+			deadline: now.Add(2 * time.Minute),
+			exp:      2 * time.Minute,
+		},
+		{
+			name:     "deadline_past",
+			deadline: now.Add(-1 * time.Minute),
+			err:      "is in the past",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			if !tc.deadline.IsZero() {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, tc.deadline)
+				t.Cleanup(cancel)
+			}
+
+			got, err := clampTTL(ctx, now, ttl)
+			if err != nil {
+				if tc.err == "" {
+					t.Fatal(err)
+				}
+				if got, want := err.Error(), tc.err; !strings.Contains(got, want) {
+					t.Errorf("expected %q to contain %q", got, want)
+				}
+			} else if tc.err != "" {
+				t.Fatalf("expected error %q, got nothing", tc.err)
+			}
+
+			if want := tc.exp; got != want {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_Acquire_unwrappedErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	writeTestLock(t, gcsServer, time.Now().Add(ttl))
+
+	checkErr(t, newTestLock(t, gcsServer).Acquire(ctx, ttl), "failed to acquire lock: lock held until")
+
+	err := newTestLock(t, gcsServer, WithUnwrappedErrors()).Acquire(ctx, ttl)
+	if _, ok := err.(*LockHeldError); !ok { //nolint:errorlint // Testing the top-level value.
+		t.Errorf("expected %v (%T) to be %T", err, err, new(LockHeldError))
+	}
+	checkErr(t, newTestLock(t, gcsServer, WithUnwrappedErrors()).Acquire(ctx, 0), "ttl 0s must be at least 1s")
+
+	// The variants of Acquire are not wrapped either.
+	lock := newTestLock(t, gcsServer, WithUnwrappedErrors())
+	cases := []struct {
+		name string
+		fn   func() error
+	}{
+		{
+			name: "acquire_at",
+			fn: func() error {
+				return lock.AcquireAt(ctx, time.Now().Add(-time.Hour), ttl)
+			},
+		},
+		{
+			name: "acquire_until",
+			fn: func() error {
+				return lock.AcquireUntil(ctx, time.Now().Add(-time.Hour))
+			},
+		},
+		{
+			name: "compare_and_acquire",
+			fn: func() error {
+				return lock.CompareAndAcquire(ctx, 0, ttl)
+			},
+		},
+		{
+			name: "acquire_as",
+			fn: func() error {
+				return lock.AcquireAs(ctx, ttl, option.WithHTTPClient(gcsServer.HTTPClient()))
+			},
+		},
+		{
+			name: "acquire_wait",
+			fn: func() error {
+				waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+				defer cancel()
+				return lock.AcquireWait(waitCtx, ttl)
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		err := tc.fn()
+		if err == nil {
+			t.Errorf("%s: expected error", tc.name)
+			continue
+		}
+		if got := err.Error(); strings.HasPrefix(got, "failed to acquire lock") {
+			t.Errorf("%s: expected %q to be unwrapped", tc.name, got)
+		}
+	}
+}
+
+func TestGCSLock_Acquire_minAcquireInterval(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	_, err := NewWithOptions(ctx, "my-bucket", "my-object", WithMinAcquireInterval(0))
+	checkErr(t, err, "must be positive")
+
+	gcsServer := newTestServer(t)
+	transport := &countingTransport{base: gcsServer.HTTPClient().Transport}
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := newTestLock(t, gcsServer, WithMinAcquireInterval(time.Minute))
+	lock.client = client
+
+	now := time.Now().UTC()
+	lock.nowFunc = func() time.Time { return now }
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	requests := transport.count.Load()
+
+	now = now.Add(30 * time.Second)
+	if err := lock.Acquire(ctx, ttl); !errors.Is(err, ErrTooSoon) {
+		t.Fatalf("expected %v to be %v", err, ErrTooSoon)
+	}
+	if got, want := transport.count.Load(), requests; got != want {
+		t.Errorf("expected %d requests to be %d", got, want)
+	}
+
+	now = now.Add(30 * time.Second)
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCSLock_Acquire_onAcquire(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	_, err := NewWithOptions(ctx, "my-bucket", "my-object", WithOnAcquire(nil))
+	checkErr(t, err, "cannot be nil")
+
+	gcsServer := newTestServer(t)
+
+	var infos []LockInfo
+	lock := newTestLock(t, gcsServer, WithOwner("node-a"),
+		WithOnAcquire(func(ctx context.Context, info LockInfo) error {
+			infos = append(infos, info)
+			return nil
+		}))
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(infos), 1; got != want {
+		t.Fatalf("expected %d to be %d", got, want)
+	}
+	if got, want := infos[0].Generation, objectGeneration(t, gcsServer); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := infos[0].Owner, "node-a"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := infos[0].NotBefore, lock.lastNotBefore(); !got.Equal(want) {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+
+	// Renewals do not call the hook.
+	if err := lock.Renew(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(infos), 1; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failing hook rolls back the acquisition.
+	hookErr := errors.New("database unavailable")
+	lock = newTestLock(t, gcsServer, WithOnAcquire(func(ctx context.Context, info LockInfo) error {
+		return hookErr
+	}))
+
+	if err := lock.Acquire(ctx, ttl); !errors.Is(err, hookErr) {
+		t.Fatalf("expected %v to be %v", err, hookErr)
+	}
+	if generation, _ := lock.LastGeneration(); generation != 0 {
+		t.Errorf("expected generation %d to be 0", generation)
+	}
+	if _, err := gcsServer.Client().
+		Bucket("my-bucket").
+		Object("my-object").
+		Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("expected %v to be %v", err, storage.ErrObjectNotExist)
+	}
+}
+
+func TestGCSLock_Acquire_timeout(t *testing.T) {
+	t.Parallel()
+
+	gcsServer := newTestServer(t)
+
+	transport := &flakyTransport{base: gcsServer.HTTPClient().Transport}
+	transport.failures.Store(math.MaxInt32)
+	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := newTestLock(t, gcsServer,
+		WithStorageRetry(storage.WithPolicy(storage.RetryNever)),
+		WithRetryJitterPercent(0),
+		WithExponentialBackoff(time.Second, time.Second, 5))
+	lock.client = client
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = lock.Acquire(ctx, 5*time.Minute)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v to be %v", err, context.DeadlineExceeded)
+	}
+	if !IsTimeout(err) {
+		t.Errorf("expected %v to be a timeout", err)
+	}
+	if errors.Is(err, ErrLockHeld) {
+		t.Errorf("expected %v to not be %v", err, ErrLockHeld)
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		err  error
+		exp  bool
+	}{
+		{
+			name: "nil",
+			err:  nil,
+			exp:  false,
+		},
+		{
+			name: "context",
+			err:  fmt.Errorf("failed to acquire lock: %w", context.DeadlineExceeded),
+			exp:  true,
+		},
+		{
+			name: "grpc",
+			err:  status.Error(codes.DeadlineExceeded, "deadline exceeded"),
+			exp:  true,
+		},
+		{
+			name: "canceled",
+			err:  context.Canceled,
+			exp:  false,
+		},
+		{
+			name: "lock_held",
+			err:  NewLockHeldError(1),
+			exp:  false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := IsTimeout(tc.err), tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_Acquire_bucketNotFound(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := fakestorage.NewServer(nil)
+	t.Cleanup(gcsServer.Stop)
+	lock := newTestLock(t, gcsServer)
+
+	// The error is not retried, so this returns without exhausting the retry
+	// policy.
+	err := lock.Acquire(ctx, 5*time.Minute)
+
+	var bucketErr *BucketNotFoundError
+	if !errors.As(err, &bucketErr) {
+		t.Fatalf("expected %s (%T) to be %T", err, err, bucketErr)
+	}
+}
+
+func TestGCSLock_Acquire_strictMetadata(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		strict   bool
+		err      string
+	}{
+		{
+			name:     "lenient_missing",
+			metadata: map[string]string{"foo": "bar"},
+		},
+		{
+			name:     "strict_missing",
+			metadata: map[string]string{"foo": "bar"},
+			strict:   true,
+			err:      "lock gs://my-bucket/my-object is corrupt: missing nbf metadata",
+		},
+		{
+			name:   "strict_no_metadata",
+			strict: true,
+			err:    "missing nbf metadata",
+		},
+		{
+			name:     "strict_invalid",
+			metadata: map[string]string{notBeforeKey: "banana"},
+			strict:   true,
+			err:      `failed to parse nbf "banana"`,
+		},
+		{
+			name:     "strict_valid",
+			metadata: map[string]string{notBeforeKey: "0"},
+			strict:   true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			gcsServer := newTestServer(t)
+			w := gcsServer.Client().Bucket("my-bucket").Object("my-object").NewWriter(ctx)
+			w.Metadata = tc.metadata
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var opts []Option
+			if tc.strict {
+				opts = append(opts, WithStrictMetadata())
+			}
+			lock := newTestLock(t, gcsServer, opts...)
+
+			err := lock.Acquire(ctx, 5*time.Minute)
+			checkErr(t, err, tc.err)
+			if tc.err != "" && !errors.Is(err, new(CorruptLockError)) {
+				t.Errorf("expected %v to be %T", err, new(CorruptLockError))
+			}
+		})
+	}
+}
+
+func TestGCSLock_Acquire_permissionDenied(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error":{"code":403,"message":"caller does not have storage.objects.get access"}}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	lock, err := NewWithOptions(ctx, "my-bucket", "my-object", WithClientOptions(
+		option.WithEndpoint(srv.URL+"/storage/v1/"),
+		option.WithoutAuthentication(),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := lock.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	err = lock.Acquire(ctx, 5*time.Minute)
+	checkErr(t, err, "permission denied on gs://my-bucket/my-object")
+
+	var permErr *PermissionDeniedError
+	if !errors.As(err, &permErr) {
+		t.Errorf("expected %v to be a PermissionDeniedError", err)
+	}
+
+	// The error is not retried.
+	if got, want := atomic.LoadInt32(&requests), int32(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+// countingTransport counts the requests made through it.
+type countingTransport struct {
+	base  http.RoundTripper
+	count atomic.Int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.count.Add(1)
+	return t.base.RoundTrip(req)
+}
+
+func TestGCSLock_Acquire_stickyOwner(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	_, err := NewWithOptions(ctx, "my-bucket", "my-object", WithStickyOwner("node-a", 0))
+	checkErr(t, err, "must be positive")
+
+	cases := []struct {
+		name    string
+		owner   string
+		expired time.Duration
+		held    bool
+	}{
+		{
+			name:    "previous_owner_in_grace",
+			owner:   "node-a",
+			expired: 10 * time.Second,
+			held:    false,
+		},
+		{
+			name:    "other_owner_in_grace",
+			owner:   "node-b",
+			expired: 10 * time.Second,
+			held:    true,
+		},
+		{
+			name:    "other_owner_after_grace",
+			owner:   "node-b",
+			expired: 2 * time.Minute,
+			held:    false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			gcsServer := newTestServer(t)
+
+			w := gcsServer.Client().Bucket("my-bucket").Object("my-object").NewWriter(ctx)
+			w.Metadata = map[string]string{
+				notBeforeKey: strconv.FormatInt(time.Now().Add(-tc.expired).Unix(), 10),
+				ownerKey:     "node-a",
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			lock := newTestLock(t, gcsServer, WithStickyOwner(tc.owner, time.Minute))
+
+			err := lock.Acquire(ctx, ttl)
+			if got, want := errors.Is(err, ErrLockHeld), tc.held; got != want {
+				t.Errorf("expected %v to be held: %t", err, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_Acquire_skipPreRead(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	cases := []struct {
+		name     string
+		opts     []Option
+		existing bool
+		requests int32
+	}{
+		{
+			name:     "default_missing",
+			requests: 2,
+		},
+		{
+			name:     "skip_missing",
+			opts:     []Option{WithSkipPreRead()},
+			requests: 1,
+		},
+		{
+			name:     "default_expired",
+			existing: true,
+			requests: 2,
+		},
+		{
+			name:     "skip_expired",
+			opts:     []Option{WithSkipPreRead()},
+			existing: true,
+			requests: 3,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			gcsServer := newTestServer(t)
+			if tc.existing {
+				writeTestLock(t, gcsServer, time.Now().Add(-ttl))
+			}
+
+			transport := &countingTransport{base: gcsServer.HTTPClient().Transport}
+			client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lock := newTestLock(t, gcsServer, tc.opts...)
+			lock.client = client
+
+			if err := lock.Acquire(ctx, ttl); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := transport.count.Load(), tc.requests; got != want {
+				t.Errorf("expected %d requests to be %d", got, want)
+			}
+
+			// The lock is held either way.
+			if err := newTestLock(t, gcsServer, tc.opts...).Acquire(ctx, ttl); !errors.Is(err, ErrLockHeld) {
+				t.Errorf("expected %v to be %v", err, ErrLockHeld)
+			}
+		})
+	}
+}
+
+// unavailableTransport returns 503 for any request to the given bucket.
+type unavailableTransport struct {
+	base   http.RoundTripper
+	bucket string
+}
+
+func (t *unavailableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.Contains(req.URL.Path, "/b/"+t.bucket+"/") {
+		return t.base.RoundTrip(req)
+	}
+
+	return unavailableResponse(req), nil
+}
+
+// unavailableResponse returns a 503 response to the request.
+func unavailableResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"error":{"code":503,"message":"unavailable"}}`)),
+		Request:    req,
+	}
+}
+
+func TestGCSLock_Acquire_fallbackBucket(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	if err := gcsServer.Client().Bucket("my-fallback").Create(ctx, "my-project", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &unavailableTransport{base: gcsServer.HTTPClient().Transport, bucket: "my-bucket"}
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := []Option{
+		WithStorageRetry(storage.WithPolicy(storage.RetryNever)),
+		WithRetryJitterPercent(0),
+		WithExponentialBackoff(time.Millisecond, time.Millisecond, 2),
+	}
+
+	// Without a fallback, the error is returned.
+	lock := newTestLock(t, gcsServer, opts...)
+	lock.client = client
+	if err := lock.Acquire(ctx, ttl); !isUnavailable(err) {
+		t.Fatalf("expected %v to be unavailable", err)
+	}
+
+	lock = newTestLock(t, gcsServer, append(opts, WithFallbackBucket("my-fallback"))...)
+	lock.client = client
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := lock.Bucket(), "my-fallback"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if _, err := gcsServer.Client().Bucket("my-fallback").Object("my-object").Attrs(ctx); err != nil {
+		t.Errorf("expected lock in fallback bucket: %s", err)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithFallbackBucket(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewWithOptions(context.Background(), "my-bucket", "my-object", WithFallbackBucket("My-Fallback")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// checksumMismatchTransport rejects the first upload with a CRC32C mismatch,
+// since the fake server does not validate checksums.
+type checksumMismatchTransport struct {
+	base     http.RoundTripper
+	rejected atomic.Bool
+}
+
+func (t *checksumMismatchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.Path, "/upload/") || t.rejected.Swap(true) {
+		return t.base.RoundTrip(req)
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body: io.NopCloser(strings.NewReader(`{"error":{"code":400,"message":` +
+			`"Provided CRC32C \"AAAAAA==\" doesn't match calculated CRC32C \"fT+mOQ==\".",` +
+			`"errors":[{"domain":"global","reason":"invalid","message":"Invalid checksum."}]}}`)),
+		Request: req,
+	}, nil
+}
+
+func TestGCSLock_Acquire_checksumMismatch(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+
+	transport := &checksumMismatchTransport{base: gcsServer.HTTPClient().Transport}
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := newTestLock(t, gcsServer, WithRetryJitterPercent(0))
+	lock.client = client
+
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !transport.rejected.Load() {
+		t.Error("expected upload to be rejected")
+	}
+	if got, want := lock.Stats().Retries, int64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+// invalidUploadTransport rejects every upload as invalid, for a reason other
+// than a checksum mismatch.
+type invalidUploadTransport struct {
+	base     http.RoundTripper
+	rejected atomic.Int32
+}
+
+func (t *invalidUploadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.Path, "/upload/") {
+		return t.base.RoundTrip(req)
+	}
+
+	t.rejected.Add(1)
+	return &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body: io.NopCloser(strings.NewReader(`{"error":{"code":400,"message":"Invalid storage class.",` +
+			`"errors":[{"domain":"global","reason":"invalid","message":"Invalid storage class."}]}}`)),
+		Request: req,
+	}, nil
+}
+
+func TestGCSLock_Acquire_invalidUpload(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+
+	transport := &invalidUploadTransport{base: gcsServer.HTTPClient().Transport}
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := newTestLock(t, gcsServer, WithRetryJitterPercent(0))
+	lock.client = client
+
+	// The error is returned right away instead of being retried.
+	err = lock.Acquire(ctx, 5*time.Minute)
+	checkErr(t, err, "Invalid storage class.")
+	if got, want := transport.rejected.Load(), int32(1); got != want {
+		t.Errorf("expected %d uploads to be %d", got, want)
+	}
+	if got, want := lock.Stats().Retries, int64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+// stripNotBeforeTransport renames the nbf metadata key in the first upload, as
+// if an intermediary dropped it.
+type stripNotBeforeTransport struct {
+	base     http.RoundTripper
+	stripped atomic.Bool
+}
+
+func (t *stripNotBeforeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.Path, "/upload/") || t.stripped.Swap(true) {
+		return t.base.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	_ = req.Body.Close()
+
+	// Keep the length unchanged so the Content-Length header stays valid.
+	body = bytes.Replace(body, []byte(`"nbf":`), []byte(`"nbx":`), 1)
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return t.base.RoundTrip(req)
+}
+
+func TestGCSLock_Acquire_verifyAfterWrite(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+
+	transport := &stripNotBeforeTransport{base: gcsServer.HTTPClient().Transport}
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := newTestLock(t, gcsServer, WithVerifyAfterWrite(), WithRetryJitterPercent(0))
+	lock.client = client
+
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !transport.stripped.Load() {
+		t.Error("expected nbf to be stripped")
+	}
+	if got, want := lock.Stats().Retries, int64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	info, err := lock.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.HeldAt(time.Now()) {
+		t.Errorf("expected lock to be held")
+	}
+	if got, want := info.Generation, objectGeneration(t, gcsServer); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+// failReadAfterUploadTransport rejects the first read of the object after an
+// upload, as if the verification read failed after the write succeeded.
+type failReadAfterUploadTransport struct {
+	base     http.RoundTripper
+	uploaded atomic.Bool
+	failed   atomic.Bool
+}
+
+func (t *failReadAfterUploadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasPrefix(req.URL.Path, "/upload/") {
+		t.uploaded.Store(true)
+		return t.base.RoundTrip(req)
+	}
+	if req.Method != http.MethodGet || !t.uploaded.Load() || t.failed.Swap(true) {
+		return t.base.RoundTrip(req)
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"error":{"code":403,"message":"forbidden"}}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestGCSLock_Acquire_verifyAfterWrite_readError(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+
+	transport := &failReadAfterUploadTransport{base: gcsServer.HTTPClient().Transport}
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := newTestLock(t, gcsServer, WithVerifyAfterWrite(), WithRetryJitterPercent(0))
+	lock.client = client
+
+	// The unverified write is undone and retried, so the lease is recorded and
+	// can be released.
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !transport.failed.Load() {
+		t.Error("expected verification read to fail")
+	}
+	if got, want := lock.Stats().Retries, int64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := first(lock.LastGeneration()), objectGeneration(t, gcsServer); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// uniformAccessTransport behaves like a bucket with uniform bucket-level
+// access, which the fake server does not support: it reports the setting on
+// the bucket and rejects uploads that set an object ACL. When
+// preconditionFailed is set, the rejection is a 412, as it is over gRPC.
+type uniformAccessTransport struct {
+	base               http.RoundTripper
+	preconditionFailed bool
+}
+
+func (t *uniformAccessTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/b/my-bucket") {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body: io.NopCloser(strings.NewReader(`{"name":"my-bucket",` +
+				`"iamConfiguration":{"uniformBucketLevelAccess":{"enabled":true}}}`)),
+			Request: req,
+		}, nil
+	}
+
+	if !strings.HasPrefix(req.URL.Path, "/upload/") || req.URL.Query().Get("predefinedAcl") == "" {
+		return t.base.RoundTrip(req)
+	}
+
+	if t.preconditionFailed {
+		return &http.Response{
+			StatusCode: http.StatusPreconditionFailed,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body: io.NopCloser(strings.NewReader(`{"error":{"code":412,"message":"Precondition Failed",` +
+				`"errors":[{"domain":"global","reason":"conditionNotMet","message":"Precondition Failed"}]}}`)),
+			Request: req,
+		}, nil
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body: io.NopCloser(strings.NewReader(`{"error":{"code":400,"message":"Invalid request.",` +
+			`"errors":[{"domain":"global","reason":"invalid","message":"Invalid request."}]}}`)),
+		Request: req,
+	}, nil
+}
+
+func TestGCSLock_Acquire_uniformAccessConflict(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name               string
+		preconditionFailed bool
+	}{
+		{
+			name: "invalid",
+		},
+		{
+			// The conflict must not be mistaken for contention and retried.
+			name:               "precondition_failed",
+			preconditionFailed: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			gcsServer := newTestServer(t)
+
+			client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{
+				Transport: &uniformAccessTransport{
+					base:               gcsServer.HTTPClient().Transport,
+					preconditionFailed: tc.preconditionFailed,
+				},
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lock := newTestLock(t, gcsServer, WithPredefinedACL("projectPrivate"))
+			lock.client = client
+
+			err = lock.Acquire(ctx, 5*time.Minute)
+			if !errors.Is(err, new(ConfigurationError)) {
+				t.Fatalf("expected %v to be %T", err, new(ConfigurationError))
+			}
+			checkErr(t, err, "uniform bucket-level access")
+			if got, want := lock.Stats().Retries, int64(0); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_uniformAccessNoACL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	cases := []struct {
+		name string
+		fn   func(ctx context.Context, lock *Lock) error
+	}{
+		{
+			name: "acquire",
+			fn: func(ctx context.Context, lock *Lock) error {
+				return lock.Acquire(ctx, ttl)
+			},
+		},
+		{
+			name: "force_acquire",
+			fn: func(ctx context.Context, lock *Lock) error {
+				return lock.ForceAcquire(ctx, ttl)
+			},
+		},
+		{
+			name: "compare_and_acquire",
+			fn: func(ctx context.Context, lock *Lock) error {
+				return lock.CompareAndAcquire(ctx, 0, ttl)
+			},
+		},
+		{
+			name: "renew",
+			fn: func(ctx context.Context, lock *Lock) error {
+				if err := lock.ForceAcquire(ctx, ttl); err != nil {
+					return err
+				}
+				return lock.Renew(ctx, ttl)
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			gcsServer := newTestServer(t)
+
+			client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{
+				Transport: &uniformAccessTransport{base: gcsServer.HTTPClient().Transport},
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// No ACL is set by default, so every write succeeds on the first try.
+			lock := newTestLock(t, gcsServer)
+			lock.client = client
+
+			if err := tc.fn(ctx, lock); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := lock.Stats().Retries, int64(0); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_writeError_uniformAccess(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	// The fake server has no gRPC transport, so classify the gRPC error that
+	// writeLease would see from a bucket with uniform bucket-level access.
+	cases := []struct {
+		name      string
+		uniform   bool
+		acl       string
+		configErr bool
+		retryable bool
+	}{
+		{
+			name:      "grpc_conflict",
+			uniform:   true,
+			acl:       "projectPrivate",
+			configErr: true,
+		},
+		{
+			name:      "grpc_contention",
+			acl:       "projectPrivate",
+			retryable: true,
+		},
+		{
+			name:      "grpc_contention_no_acl",
+			uniform:   true,
+			retryable: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			gcsServer := newTestServer(t)
+			lock := newTestLock(t, gcsServer)
+			if tc.uniform {
+				client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{
+					Transport: &uniformAccessTransport{base: gcsServer.HTTPClient().Transport},
+				}))
+				if err != nil {
+					t.Fatal(err)
+				}
+				lock.client = client
+			}
+
+			err := lock.writeError(ctx, tc.acl, status.Error(codes.FailedPrecondition, "failed precondition"))
+			if got, want := errors.Is(err, new(ConfigurationError)), tc.configErr; got != want {
+				t.Errorf("expected %v to be ConfigurationError: %t", err, want)
+			}
+
+			// Retryable errors are attempted again.
+			var calls int
+			_ = retry.Do(ctx, retry.WithMaxRetries(1, retry.NewConstant(time.Millisecond)), func(context.Context) error {
+				calls++
+				return err
+			})
+			if got, want := calls == 2, tc.retryable; got != want {
+				t.Errorf("expected %v to be retryable: %t", err, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_Acquire_createBucketIfMissing(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := fakestorage.NewServer(nil)
+	t.Cleanup(gcsServer.Stop)
+	lock := newTestLock(t, gcsServer, WithCreateBucketIfMissing("my-project", nil))
+
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gcsServer.Client().Bucket("my-bucket").Attrs(ctx); err != nil {
+		t.Errorf("expected bucket to exist: %s", err)
+	}
+
+	// The bucket already exists, which is not an error.
+	other := newTestLock(t, gcsServer, WithCreateBucketIfMissing("my-project", nil))
+	if err := other.createBucket(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+// bucketConflictTransport rejects bucket creation with a conflict of the given
+// reason, and denies access to the bucket if it is owned by another project.
+type bucketConflictTransport struct {
+	base   http.RoundTripper
+	reason string
+}
+
+func (t *bucketConflictTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/b"):
+		return &http.Response{
+			StatusCode: http.StatusConflict,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body: io.NopCloser(strings.NewReader(`{"error":{"code":409,"message":"Conflict.",` +
+				`"errors":[{"domain":"global","reason":"` + t.reason + `","message":"Conflict."}]}}`)),
+			Request: req,
+		}, nil
+	case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/b/my-bucket") && t.reason == "conflict":
+		return &http.Response{
+			StatusCode: http.StatusForbidden,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"error":{"code":403,"message":"forbidden"}}`)),
+			Request:    req,
+		}, nil
+	}
+	return t.base.RoundTrip(req)
+}
+
+func TestGCSLock_createBucket_conflict(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name   string
+		reason string
+		err    string
+	}{
+		{
+			name:   "already_own",
+			reason: "youAlreadyOwnThisBucket",
+		},
+		{
+			name:   "other_project",
+			reason: "conflict",
+			err:    "bucket name is taken by another project",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			gcsServer := fakestorage.NewServer(nil)
+			t.Cleanup(gcsServer.Stop)
+
+			client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{
+				Transport: &bucketConflictTransport{base: gcsServer.HTTPClient().Transport, reason: tc.reason},
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lock := newTestLock(t, gcsServer, WithCreateBucketIfMissing("my-project", nil))
+			lock.client = client
+
+			checkErr(t, lock.createBucket(ctx), tc.err)
+		})
+	}
+}
+
+func TestGCSLock_Acquire_dryRun(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	cases := []struct {
+		name      string
+		gcsServer func(tb testing.TB) *fakestorage.Server
+		err       string
+	}{
+		{
+			name: "bucket_no_exist",
+			gcsServer: func(tb testing.TB) *fakestorage.Server {
+				tb.Helper()
+
+				srv := fakestorage.NewServer(nil)
+				tb.Cleanup(srv.Stop)
+				return srv
+			},
+			err: `bucket "my-bucket" does not exist`,
+		},
+		{
+			name:      "object_no_exist",
+			gcsServer: newTestServer,
+		},
+		{
+			name: "lock_exists_not_expired",
+			gcsServer: func(tb testing.TB) *fakestorage.Server {
+				tb.Helper()
+
+				srv := newTestServer(tb)
+				writeTestLock(tb, srv, time.Now().Add(ttl))
+				return srv
+			},
+			err: "lock held until",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			gcsServer := tc.gcsServer(t)
+			lock := newTestLock(t, gcsServer, WithDryRun())
+
+			var generation int64
+			if attrs, err := gcsServer.Client().Bucket("my-bucket").Object("my-object").Attrs(ctx); err == nil {
+				generation = attrs.Generation
+			}
+
+			checkErr(t, lock.Acquire(ctx, ttl), tc.err)
+
+			// Nothing was written.
+			var got int64
+			if attrs, err := gcsServer.Client().Bucket("my-bucket").Object("my-object").Attrs(ctx); err == nil {
+				got = attrs.Generation
+			}
+			if want := generation; got != want {
+				t.Errorf("expected generation %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_Acquire_subSecondTTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name     string
+		ttl      time.Duration
+		deadline time.Duration
+		err      string
+	}{
+		{
+			name: "zero",
+			ttl:  0,
+			err:  "ttl 0s must be at least 1s",
+		},
+		{
+			name: "half_second",
+			ttl:  500 * time.Millisecond,
+			err:  "ttl 500ms must be at least 1s",
+		},
+		{
+			name: "one_second",
+			ttl:  time.Second,
+		},
+		{
+			name:     "clamped_below_one_second",
+			ttl:      time.Minute,
+			deadline: 500 * time.Millisecond,
+			err:      "must be at least 1s",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := ctx
+			var opts []Option
+			if tc.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.deadline)
+				t.Cleanup(cancel)
+				opts = append(opts, WithClampToContextDeadline())
+			}
+
+			gcsServer := newTestServer(t)
+			lock := newTestLock(t, gcsServer, opts...)
+			checkErr(t, lock.Acquire(ctx, tc.ttl), tc.err)
+
+			// Nothing is written when the ttl is rejected.
+			if tc.err != "" {
+				if _, err := gcsServer.GetObject("my-bucket", "my-object"); err == nil {
+					t.Errorf("expected lock object to not exist")
+				}
+			}
+		})
+	}
+}
+
+func TestGCSLock_Acquire_maxTTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer, WithMaxTTL(time.Hour))
+
+	err := lock.Acquire(ctx, 48*time.Hour)
+	checkErr(t, err, "ttl 48h0m0s exceeds maximum of 1h0m0s")
+
+	// Nothing was written.
+	held, err := lock.Held(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held {
+		t.Errorf("expected lock to not be held")
+	}
+
+	if err := lock.Acquire(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCSLock_Acquire_operationTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+
+	lock := newTestLock(t, gcsServer, WithOperationTimeout(time.Nanosecond))
+	if err := lock.Acquire(ctx, time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v to be %v", err, context.DeadlineExceeded)
+	}
+
+	lock = newTestLock(t, gcsServer, WithOperationTimeout(time.Minute))
+	if err := lock.Acquire(ctx, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCSLock_Acquire_clockSkew(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+
+	// The lock expired by our clock, but is within the skew.
+	nbf := time.Now().Add(-2 * time.Second).Truncate(time.Second)
+	writeTestLock(t, gcsServer, nbf)
+
+	lock := newTestLock(t, gcsServer, WithClockSkew(time.Minute))
+	var lockErr *LockHeldError
+	if err := lock.Acquire(ctx, time.Minute); !errors.As(err, &lockErr) {
+		t.Fatalf("expected %v to be a LockHeldError", err)
+	}
+	if got, want := lockErr.NotBefore(), nbf.Add(time.Minute).UTC(); !got.Equal(want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// The skew also applies to the other ways of acquiring the lock.
+	if err := lock.ForceAcquire(ctx, time.Minute); !errors.Is(err, new(LockHeldError)) {
+		t.Errorf("expected %v to be %T", err, new(LockHeldError))
+	}
+	if err := lock.AcquireIf(ctx, time.Minute, func(LockInfo) bool { return true }); !errors.Is(err, new(LockHeldError)) {
+		t.Errorf("expected %v to be %T", err, new(LockHeldError))
+	}
+
+	// Without the skew, the lock is available.
+	if err := newTestLock(t, gcsServer).Acquire(ctx, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCSLock_AcquireUntil(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer, WithMaxTTL(time.Hour))
+
+	err := lock.AcquireUntil(ctx, time.Now().Add(-time.Second))
+	checkErr(t, err, "is not in the future")
+
+	err = lock.AcquireUntil(ctx, time.Now().Add(2*time.Hour))
+	checkErr(t, err, "exceeds maximum of 1h0m0s")
+
+	until := time.Now().Add(10 * time.Minute)
+	if err := lock.AcquireUntil(ctx, until); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := lock.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.NotBefore, time.Unix(until.Unix(), 0).UTC(); !got.Equal(want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestGCSLock_AcquireAt(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	err := lock.AcquireAt(ctx, time.Now().Add(-time.Hour), ttl)
+	checkErr(t, err, "is in the past")
+
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := lock.AcquireAt(ctx, start, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := lock.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.NotBefore, start.Add(ttl).UTC(); !got.Equal(want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// The reservation holds the lock, so a later window cannot be reserved.
+	other := newTestLock(t, gcsServer)
+	var lockErr *LockHeldError
+	if err := other.AcquireAt(ctx, start.Add(2*ttl), ttl); !errors.As(err, &lockErr) {
+		t.Errorf("expected %v to be a LockHeldError", err)
+	}
+
+	// The reservation is subject to the maximum ttl.
+	capped := newTestLock(t, gcsServer, WithMaxTTL(30*time.Minute))
+	err = capped.AcquireAt(ctx, start, ttl)
+	checkErr(t, err, "exceeds maximum of 30m0s")
+}
+
+func TestGCSLock_CompareAndAcquire(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	// The object must not exist.
+	if err := lock.CompareAndAcquire(ctx, 0, ttl); err != nil {
+		t.Fatal(err)
+	}
+	generation := objectGeneration(t, gcsServer)
+
+	var mismatchErr *GenerationMismatchError
+	if err := lock.CompareAndAcquire(ctx, 0, ttl); !errors.As(err, &mismatchErr) {
+		t.Fatalf("expected %v to be a GenerationMismatchError", err)
+	}
+	if got, want := mismatchErr.Expected(), int64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	if err := lock.CompareAndAcquire(ctx, generation+1, ttl); !errors.As(err, &mismatchErr) {
+		t.Errorf("expected %v to be a GenerationMismatchError", err)
+	}
+
+	// The lease has not expired, but the generation matches.
+	if err := lock.CompareAndAcquire(ctx, generation, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := first(lock.LastGeneration()), objectGeneration(t, gcsServer); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestGCSLock_CompareAndAcquire_dryRun(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer, WithDryRun())
+
+	// The object does not exist, so this would succeed, but nothing is written.
+	if err := lock.CompareAndAcquire(ctx, 0, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gcsServer.Client().
+		Bucket("my-bucket").
+		Object("my-object").
+		Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("expected %v to be %v", err, storage.ErrObjectNotExist)
+	}
+
+	writeTestLock(t, gcsServer, time.Now().Add(ttl))
+	generation := objectGeneration(t, gcsServer)
+
+	if err := lock.CompareAndAcquire(ctx, 0, ttl); !errors.Is(err, new(GenerationMismatchError)) {
+		t.Errorf("expected %v to be %T", err, new(GenerationMismatchError))
+	}
+	if err := lock.CompareAndAcquire(ctx, generation, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := objectGeneration(t, gcsServer), generation; got != want {
+		t.Errorf("expected generation %d to be %d", got, want)
+	}
+	if got, want := first(lock.LastGeneration()), int64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestGCSLock_AcquireIf(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	olderVersion := func(info LockInfo) bool {
+		return info.Metadata["version"] < "2"
+	}
+
+	gcsServer := newTestServer(t)
+	v1 := newTestLock(t, gcsServer, WithMetadata(map[string]string{"version": "1"}))
+	v2 := newTestLock(t, gcsServer, WithMetadata(map[string]string{"version": "2"}))
+
+	if err := v1.AcquireIf(ctx, ttl, nil); err == nil {
+		t.Errorf("expected error")
+	}
+
+	// The predicate is not consulted when the object does not exist.
+	if err := v2.AcquireIf(ctx, ttl, func(LockInfo) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+
+	// A lease that has not expired is never taken over.
+	if err := v1.AcquireIf(ctx, ttl, olderVersion); !errors.Is(err, new(LockHeldError)) {
+		t.Fatalf("expected %v to be %T", err, new(LockHeldError))
+	}
+
+	// The predicate rejects an expired holder that is not older.
+	if err := v2.Expire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err := v1.AcquireIf(ctx, ttl, olderVersion)
+	var predErr *PredicateFailedError
+	if !errors.As(err, &predErr) {
+		t.Fatalf("expected %v to be %T", err, predErr)
+	}
+	if got, want := predErr.Info().Metadata["version"], "2"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// The predicate is checked, but nothing is written, in dry-run mode.
+	dryRun := newTestLock(t, gcsServer, WithDryRun(), WithMetadata(map[string]string{"version": "3"}))
+	if err := dryRun.AcquireIf(ctx, ttl, olderVersion); !errors.Is(err, new(PredicateFailedError)) {
+		t.Errorf("expected %v to be %T", err, new(PredicateFailedError))
+	}
+	generation := objectGeneration(t, gcsServer)
+	if err := dryRun.AcquireIf(ctx, ttl, func(LockInfo) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := objectGeneration(t, gcsServer), generation; got != want {
+		t.Errorf("expected generation %d to be %d", got, want)
+	}
+
+	// An expired holder that passes the predicate is taken over.
+	if err := v1.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1.Expire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := v2.AcquireIf(ctx, ttl, olderVersion); err != nil {
+		t.Fatal(err)
+	}
+	generation, _ = v2.LastGeneration()
+	if got, want := objectGeneration(t, gcsServer), generation; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	// Objects that do not look like locks are refused in strict mode.
+	w := gcsServer.Client().Bucket("my-bucket").Object("my-object").NewWriter(ctx)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	strict := newTestLock(t, gcsServer, WithStrictMetadata())
+	if err := strict.AcquireIf(ctx, ttl, func(LockInfo) bool { return true }); !errors.Is(err, new(CorruptLockError)) {
+		t.Errorf("expected %v to be %T", err, new(CorruptLockError))
+	}
+}
+
+func TestGCSLock_AcquireFenced(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	first, err := lock.AcquireFenced(ctx, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expire the lock so it can be acquired again.
+	writeTestLock(t, gcsServer, time.Now().Add(-time.Minute))
+
+	second, err := lock.AcquireFenced(ctx, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if second <= first {
+		t.Errorf("expected %d to be greater than %d", second, first)
+	}
+}
+
+// flakyTransport returns 503, or the given status code, for the next failures
+// requests.
+type flakyTransport struct {
+	base     http.RoundTripper
+	code     int
+	failures atomic.Int32
+}
+
+func (t *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.failures.Add(-1) < 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	if t.code != 0 {
+		return &http.Response{
+			StatusCode: t.code,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(fmt.Sprintf(`{"error":{"code":%d,"message":"throttled"}}`, t.code))),
+			Request:    req,
+		}, nil
+	}
+	return unavailableResponse(req), nil
+}
+
+func TestGCSLock_Acquire_throttledTwice(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+
+	transport := &flakyTransport{base: gcsServer.HTTPClient().Transport, code: http.StatusTooManyRequests}
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := newTestLock(t, gcsServer,
+		WithStorageRetry(storage.WithPolicy(storage.RetryNever)),
+		WithRetryJitterPercent(0),
+		WithExponentialBackoff(time.Millisecond, time.Millisecond, 3))
+	lock.client = client
+
+	// Both calls are throttled and need retries; the first must not use up the
+	// retry budget of the second.
+	for i := 0; i < 2; i++ {
+		transport.failures.Store(3)
+		if err := lock.Acquire(ctx, ttl); err != nil {
+			t.Fatalf("call %d: %s", i, err)
+		}
+		if err := lock.Release(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := lock.Stats().Retries, int64(6); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestGCSLock_TryAcquireWithInfo(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer, WithOwner("node-a"), WithClockSkew(time.Minute))
+
+	acquired, info, err := lock.TryAcquireWithInfo(ctx, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acquired {
+		t.Errorf("expected lock to be acquired")
+	}
+	if info != nil {
+		t.Errorf("expected %v to be nil", info)
+	}
+	nbf := lock.lastNotBefore()
+
+	other := newTestLock(t, gcsServer, WithOwner("node-b"), WithClockSkew(time.Minute))
+	acquired, info, err = other.TryAcquireWithInfo(ctx, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acquired {
+		t.Errorf("expected lock to not be acquired")
+	}
+	if info == nil {
+		t.Fatal("expected info")
+	}
+	if got, want := info.Owner, "node-a"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	// The stored expiration excludes the clock skew allowance.
+	if got, want := info.NotBefore, nbf; !got.Equal(want) {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+
+	// Genuine failures are errors.
+	if _, _, err := other.TryAcquireWithInfo(ctx, 0); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestGCSLock_AcquireAs(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	transport := &countingTransport{base: gcsServer.HTTPClient().Transport}
+	creds := option.WithHTTPClient(&http.Client{Transport: transport})
+
+	if err := lock.AcquireAs(ctx, 5*time.Minute, creds); err != nil {
+		t.Fatal(err)
+	}
+	if transport.count.Load() == 0 {
+		t.Error("expected requests to use the per-call client")
+	}
+
+	// The lease is recorded on the lock.
+	if got, want := lock.Stats().Acquires, int64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGCSLock_AcquireResult(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+
+	transport := &flakyTransport{base: gcsServer.HTTPClient().Transport}
+	transport.failures.Store(2)
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := newTestLock(t, gcsServer,
+		WithStorageRetry(storage.WithPolicy(storage.RetryNever)),
+		WithRetryJitterPercent(0),
+		WithExponentialBackoff(time.Millisecond, time.Millisecond, 5))
+	lock.client = client
+
+	result, err := lock.AcquireResult(ctx, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := result.Attempts, 3; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if result.Duration <= 0 {
+		t.Errorf("expected %s to be positive", result.Duration)
+	}
+
+	info, err := lock.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := result.NotBefore, info.NotBefore; !got.Equal(want) {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+}
+
+func TestGCSLock_LastGeneration(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	if generation, metageneration := lock.LastGeneration(); generation != 0 || metageneration != 0 {
+		t.Errorf("expected zeros, got %d, %d", generation, metageneration)
+	}
+
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, err := gcsServer.Client().Bucket("my-bucket").Object("my-object").Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generation, metageneration := lock.LastGeneration()
+	if got, want := generation, attrs.Generation; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := metageneration, attrs.Metageneration; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestGCSLock_Renew(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	// Renewing before acquiring fails.
+	if err := lock.Renew(ctx, ttl); !errors.Is(err, new(NotLockOwnerError)) {
+		t.Fatalf("expected %v to be %T", err, new(NotLockOwnerError))
+	}
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	generation, _ := lock.LastGeneration()
+
+	if err := lock.Renew(ctx, 2*ttl); err != nil {
+		t.Fatal(err)
+	}
+	if got, old := objectGeneration(t, gcsServer), generation; got == old {
+		t.Errorf("expected generation %d to change", got)
+	}
+
+	// Simulate another process taking the lock.
+	writeTestLock(t, gcsServer, time.Now().Add(ttl))
+
+	if err := lock.Renew(ctx, ttl); !errors.Is(err, new(NotLockOwnerError)) {
+		t.Fatalf("expected %v to be %T", err, new(NotLockOwnerError))
+	}
+}
+
+func TestGCSLock_RenewIfExpiringWithin(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	if _, err := lock.RenewIfExpiringWithin(ctx, time.Minute, ttl); !errors.Is(err, new(NotLockOwnerError)) {
+		t.Fatalf("expected %v to be %T", err, new(NotLockOwnerError))
+	}
+
+	now := time.Now()
+	lock.nowFunc = func() time.Time { return now }
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	generation := objectGeneration(t, gcsServer)
+
+	// Plenty of time remains.
+	renewed, err := lock.RenewIfExpiringWithin(ctx, time.Minute, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed {
+		t.Errorf("expected lease to not be renewed")
+	}
+	if got, want := objectGeneration(t, gcsServer), generation; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	// Advance the clock so the lease expires within the threshold.
+	now = now.Add(ttl - 30*time.Second)
+	renewed, err = lock.RenewIfExpiringWithin(ctx, time.Minute, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !renewed {
+		t.Errorf("expected lease to be renewed")
+	}
+	if got, old := objectGeneration(t, gcsServer), generation; got == old {
+		t.Errorf("expected generation %d to change", got)
+	}
+}
+
+func TestGCSLock_RenewToAtLeast(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	now := time.Now()
+	lock.nowFunc = func() time.Time { return now }
+	target := now.Add(2 * ttl)
+
+	if err := lock.RenewToAtLeast(ctx, target); !errors.Is(err, new(NotLockOwnerError)) {
+		t.Fatalf("expected %v to be %T", err, new(NotLockOwnerError))
+	}
+	checkErr(t, lock.RenewToAtLeast(ctx, now), "is not in the future")
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent callers extend the lease exactly once.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := lock.RenewToAtLeast(ctx, target); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := lock.Stats().Renewals, int64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	info, err := lock.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.NotBefore, target.UTC().Truncate(time.Second); !got.Equal(want) {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+
+	// An earlier target does not write.
+	generation := objectGeneration(t, gcsServer)
+	if err := lock.RenewToAtLeast(ctx, now.Add(ttl)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := objectGeneration(t, gcsServer), generation; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestGCSLock_ExtendBy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer, WithMaxTTL(time.Hour))
+
+	now := time.Now()
+	lock.nowFunc = func() time.Time { return now }
+
+	if err := lock.ExtendBy(ctx, time.Minute); !errors.Is(err, new(NotLockOwnerError)) {
+		t.Fatalf("expected %v to be %T", err, new(NotLockOwnerError))
+	}
+	checkErr(t, lock.ExtendBy(ctx, time.Millisecond), "must be at least 1s")
+
+	nbf, err := lock.AcquireLease(ctx, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The delta is added to the current expiration, not to now.
+	now = now.Add(time.Minute)
+	if err := lock.ExtendBy(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	info, err := lock.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.NotBefore, nbf.Add(5*time.Minute); !got.Equal(want) {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+
+	checkErr(t, lock.ExtendBy(ctx, time.Hour), "exceeds maximum of 1h0m0s")
+
+	// An expired lease is not extended.
+	now = now.Add(time.Hour)
+	if err := lock.ExtendBy(ctx, time.Minute); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("expected %v to be %v", err, ErrLockHeld)
+	}
+}
+
+func TestGCSLock_AcquireOrExtend(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	// Acquires when missing.
+	if err := lock.AcquireOrExtend(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	generation := objectGeneration(t, gcsServer)
+
+	// Extends while held by us.
+	if err := lock.AcquireOrExtend(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if got := objectGeneration(t, gcsServer); got == generation {
+		t.Errorf("expected generation %d to change", got)
+	}
+
+	// Fails while held by someone else.
+	writeTestLock(t, gcsServer, time.Now().Add(ttl))
+
+	var lockErr *LockHeldError
+	if err := lock.AcquireOrExtend(ctx, ttl); !errors.As(err, &lockErr) {
+		t.Fatalf("expected %s (%T) to be %T", err, err, lockErr)
+	}
+
+	// Acquires once the other lease expires.
+	writeTestLock(t, gcsServer, time.Now().Add(-ttl))
+
+	if err := lock.AcquireOrExtend(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCSLock_ForceAcquire(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	cases := []struct {
+		name   string
+		nbf    time.Time
+		opts   []Option
+		dryRun bool
+		err    string
+	}{
+		{
+			name: "missing",
+		},
+		{
+			name: "expired",
+			nbf:  time.Now().Add(-ttl),
+		},
+		{
+			name: "held",
+			nbf:  time.Now().Add(ttl),
+			err:  "lock held until",
+		},
+		{
+			name: "held_force",
+			nbf:  time.Now().Add(ttl),
+			opts: []Option{WithForce()},
+		},
+		{
+			name: "held_dry_run",
+			nbf:  time.Now().Add(ttl),
+			opts: []Option{WithDryRun()},
+			err:  "lock held until",
+		},
+		{
+			name:   "held_force_dry_run",
+			nbf:    time.Now().Add(ttl),
+			opts:   []Option{WithForce(), WithDryRun()},
+			dryRun: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			gcsServer := newTestServer(t)
+			if !tc.nbf.IsZero() {
+				writeTestLock(t, gcsServer, tc.nbf)
+			}
+			lock := newTestLock(t, gcsServer, tc.opts...)
+
+			var generation int64
+			if !tc.nbf.IsZero() {
+				generation = objectGeneration(t, gcsServer)
+			}
+
+			err := lock.ForceAcquire(ctx, ttl)
+			checkErr(t, err, tc.err)
+
+			switch {
+			case tc.dryRun:
+				// Nothing was written.
+				if got, want := objectGeneration(t, gcsServer), generation; got != want {
+					t.Errorf("expected generation %d to be %d", got, want)
+				}
+				if got, want := first(lock.LastGeneration()), int64(0); got != want {
+					t.Errorf("expected %d to be %d", got, want)
+				}
+			case err == nil:
+				if got, want := first(lock.LastGeneration()), objectGeneration(t, gcsServer); got != want {
+					t.Errorf("expected %d to be %d", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGCSLock_Transfer(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	outgoing := newTestLock(t, gcsServer, WithOwner("pod-1"))
+	successor := newTestLock(t, gcsServer, WithOwner("pod-2"))
+
+	if err := outgoing.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := outgoing.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Owner, "pod-1"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if _, ok := info.Metadata[ownerKey]; ok {
+		t.Errorf("expected owner to be omitted from metadata")
+	}
+
+	if err := outgoing.Transfer(ctx, "pod-2", ttl); err != nil {
+		t.Fatal(err)
+	}
+	if got := first(outgoing.LastGeneration()); got != 0 {
+		t.Errorf("expected outgoing lease to be cleared, got generation %d", got)
+	}
+
+	// The lock is held without a gap, now by the successor.
+	info, err = successor.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.HeldAt(time.Now()) {
+		t.Errorf("expected lock to be held")
+	}
+	if got, want := info.Owner, "pod-2"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// The successor adopts and renews the lease.
+	if err := successor.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := successor.Renew(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	// The outgoing process can no longer transfer the lock.
+	var lockErr *LockHeldError
+	if err := outgoing.Transfer(ctx, "pod-3", ttl); !errors.As(err, &lockErr) {
+		t.Fatalf("expected %v to be a LockHeldError", err)
+	}
+	if got, want := lockErr.Owner(), "pod-2"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// Acquiring reports the owner too.
+	if err := outgoing.Acquire(ctx, ttl); !errors.As(err, &lockErr) {
+		t.Fatalf("expected %v to be a LockHeldError", err)
+	}
+	if got, want := lockErr.Owner(), "pod-2"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestGCSLock_Drain(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Drain()
+	lock.Drain()
+
+	if err := lock.Renew(ctx, ttl); !errors.Is(err, ErrDraining) {
+		t.Errorf("expected %v to be %v", err, ErrDraining)
+	}
+	if err := lock.Acquire(ctx, ttl); !errors.Is(err, ErrDraining) {
+		t.Errorf("expected %v to be %v", err, ErrDraining)
+	}
+
+	// The existing lease is still valid and can be released.
+	held, err := lock.Held(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !held {
+		t.Errorf("expected lock to be held")
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCSLock_Expire(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer, WithMetadata(map[string]string{"region": "us-east1"}))
+	other := newTestLock(t, gcsServer)
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lock.Expire(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := lock.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.HeldAt(time.Now()) {
+		t.Errorf("expected lock to be expired")
+	}
+	if got, want := info.Metadata["region"], "us-east1"; got != want {
+		t.Errorf("expected metadata to be preserved, got %q", got)
+	}
+
+	// Another process can now acquire the lock, after which we can no longer
+	// expire it.
+	if err := other.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	var lockErr *LockHeldError
+	if err := lock.Expire(ctx); !errors.As(err, &lockErr) {
+		t.Fatalf("expected %s (%T) to be %T", err, err, lockErr)
+	}
+}
+
+func TestGCSLock_Release(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gcsServer.Client().
+		Bucket("my-bucket").
+		Object("my-object").
+		Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("expected %v to be %v", err, storage.ErrObjectNotExist)
+	}
+
+	// Releasing again fails, since we no longer hold the lock.
+	if err := lock.Release(ctx); !errors.Is(err, new(NotLockOwnerError)) {
+		t.Fatalf("expected %v to be %T", err, new(NotLockOwnerError))
+	}
+}
+
+func TestGCSLock_ownershipToken(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	objectToken := func(tb testing.TB) string {
+		tb.Helper()
+
+		attrs, err := gcsServer.Client().Bucket("my-bucket").Object("my-object").Attrs(ctx)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return attrs.Metadata[tokenKey]
+	}
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	token := objectToken(t)
+	if token == "" {
+		t.Fatal("expected token to be set")
+	}
+	if got, want := lock.lastToken(), token; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// Renewing keeps the token.
+	if err := lock.Renew(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := objectToken(t), token; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// A different token at the same generation means the lease is not ours.
+	generation, metageneration := lock.LastGeneration()
+	lock.setLastGeneration(generation, metageneration, "not-my-token")
+	if err := lock.Release(ctx); !errors.Is(err, new(NotLockOwnerError)) {
+		t.Fatalf("expected %v to be %T", err, new(NotLockOwnerError))
+	}
+	if got, want := objectGeneration(t, gcsServer), generation; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if generation, _ := lock.LastGeneration(); generation != 0 {
+		t.Errorf("expected generation %d to be cleared", generation)
+	}
+}
+
+func TestGCSLock_Reset(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer, WithStateCache(time.Minute))
+
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lock.Info(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Reset()
+
+	if generation, metageneration := lock.LastGeneration(); generation != 0 || metageneration != 0 {
+		t.Errorf("expected %d/%d to be cleared", generation, metageneration)
+	}
+	if got := lock.lastToken(); got != "" {
+		t.Errorf("expected %q to be cleared", got)
+	}
+	if lock.state.cachedInfo != nil {
+		t.Errorf("expected cached info to be cleared")
+	}
+	if err := lock.Renew(ctx, time.Minute); !errors.Is(err, new(NotLockOwnerError)) {
+		t.Errorf("expected %v to be %T", err, new(NotLockOwnerError))
+	}
+}
+
+func TestGCSLock_Refresh(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a write whose response was lost, leaving the cache stale.
+	writeTestLock(t, gcsServer, time.Now().Add(ttl))
+
+	if err := lock.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := first(lock.LastGeneration()), objectGeneration(t, gcsServer); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	// Renewing now succeeds with the refreshed preconditions.
+	if err := lock.Renew(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gcsServer.Client().Bucket("my-bucket").Object("my-object").Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lock.Refresh(ctx); !errors.Is(err, ErrLockGone) {
+		t.Errorf("expected %v to be %v", err, ErrLockGone)
+	}
+	if got, want := first(lock.LastGeneration()), int64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestGCSLock_AcquireWithAutoRenew(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	release, errCh, err := lock.AcquireWithAutoRenew(ctx, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generation := objectGeneration(t, gcsServer)
+
+	// Wait for at least one renewal.
+	time.Sleep(1500 * time.Millisecond)
+
+	if got, old := objectGeneration(t, gcsServer), generation; got == old {
+		t.Errorf("expected generation %d to change", got)
+	}
+
+	release()
+	release()
+
+	if err, ok := <-errCh; ok {
+		t.Errorf("expected channel to be closed, got %v", err)
+	}
+
+	if _, err := gcsServer.Client().
+		Bucket("my-bucket").
+		Object("my-object").
+		Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("expected %v to be %v", err, storage.ErrObjectNotExist)
+	}
+}
+
+func TestGCSLock_AcquireWithAutoRenew_lost(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	release, errCh, err := lock.AcquireWithAutoRenew(ctx, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	// Simulate another process taking the lock between renewals.
+	writeTestLock(t, gcsServer, time.Now().Add(time.Hour))
+	generation := objectGeneration(t, gcsServer)
+
+	select {
+	case err, ok := <-errCh:
+		if !ok {
+			t.Fatal("expected an error, got closed channel")
+		}
+		if !errors.Is(err, new(NotLockOwnerError)) {
+			t.Errorf("expected %v to be %T", err, new(NotLockOwnerError))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected lease loss to be signalled")
+	}
+
+	// The renewer must stop after the first loss, without sending again.
+	select {
+	case err, ok := <-errCh:
+		if ok {
+			t.Errorf("expected channel to be closed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected channel to be closed")
+	}
+
+	if got, want := objectGeneration(t, gcsServer), generation; got != want {
+		t.Errorf("expected generation %d to be %d", got, want)
+	}
+}
+
+// racedUploadTransport rejects uploads with a failed precondition once
+// enabled, as if another process wrote the object after our pre-read.
+type racedUploadTransport struct {
+	base     http.RoundTripper
+	enabled  atomic.Bool
+	rejected atomic.Int32
+}
+
+func (t *racedUploadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.Path, "/upload/") || !t.enabled.Load() {
+		return t.base.RoundTrip(req)
+	}
+
+	t.rejected.Add(1)
+	return &http.Response{
+		StatusCode: http.StatusPreconditionFailed,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body: io.NopCloser(strings.NewReader(`{"error":{"code":412,"message":"Precondition Failed",` +
+			`"errors":[{"domain":"global","reason":"conditionNotMet","message":"Precondition Failed"}]}}`)),
+		Request: req,
+	}, nil
+}
+
+func TestGCSLock_AcquireWithAutoRenew_lostRace(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+
+	transport := &racedUploadTransport{base: gcsServer.HTTPClient().Transport}
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := newTestLock(t, gcsServer)
+	lock.client = client
+
+	release, errCh, err := lock.AcquireWithAutoRenew(ctx, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	// The pre-read still finds our lease, but the conditional write fails.
+	transport.enabled.Store(true)
+
+	select {
+	case err, ok := <-errCh:
+		if !ok {
+			t.Fatal("expected an error, got closed channel")
+		}
+		if !errors.Is(err, new(NotLockOwnerError)) {
+			t.Errorf("expected %v to be %T", err, new(NotLockOwnerError))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected lease loss to be signalled")
+	}
+
+	// The failed write is not retried.
+	select {
+	case err, ok := <-errCh:
+		if ok {
+			t.Errorf("expected channel to be closed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected channel to be closed")
+	}
+	if got, want := transport.rejected.Load(), int32(1); got != want {
+		t.Errorf("expected %d rejected writes to be %d", got, want)
+	}
+}
+
+// newTestServer creates a fake storage server with an empty "my-bucket".
+func newTestServer(tb testing.TB) *fakestorage.Server {
+	tb.Helper()
+
+	srv := fakestorage.NewServer(nil)
+	tb.Cleanup(srv.Stop)
+
+	if err := srv.Client().Bucket("my-bucket").Create(context.Background(), "my-project", nil); err != nil {
+		tb.Fatal(err)
+	}
+	return srv
+}
+
+// newTestLock creates a lock on "my-bucket/my-object" that talks to the given
+// fake storage server.
+func newTestLock(tb testing.TB, srv *fakestorage.Server, opts ...Option) *Lock {
+	tb.Helper()
+
+	ctx := context.Background()
+
+	lock, err := NewWithOptions(ctx, "my-bucket", "my-object", opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := lock.Close(ctx); err != nil {
+			tb.Fatal(err)
+		}
+	})
+
+	lock.client = srv.Client()
+	return lock
+}
+
+// writeTestLock writes "my-bucket/my-object" with the given nbf, as if it were
+// acquired by another process.
+func writeTestLock(tb testing.TB, srv *fakestorage.Server, nbf time.Time) {
+	tb.Helper()
+
+	w := srv.Client().Bucket("my-bucket").Object("my-object").NewWriter(context.Background())
+	w.Metadata = map[string]string{
+		notBeforeKey: strconv.FormatInt(nbf.Unix(), 10),
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// objectGeneration returns the current generation of "my-bucket/my-object".
+func objectGeneration(tb testing.TB, srv *fakestorage.Server) int64 {
+	tb.Helper()
+
+	attrs, err := srv.Client().Bucket("my-bucket").Object("my-object").Attrs(context.Background())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return attrs.Generation
+}
+
+func TestGCSLock_newWriter(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	nbf := time.Unix(1902902494, 0).UTC()
+
+	cases := []struct {
+		name  string
+		opts  []Option
+		check func(tb testing.TB, w *storage.Writer)
+	}{
+		{
+			name: "defaults",
+			check: func(tb testing.TB, w *storage.Writer) {
+				tb.Helper()
+
+				if got, want := w.ChunkSize, defaultChunkSize; got != want {
+					tb.Errorf("expected %d to be %d", got, want)
+				}
+				if got, want := w.CacheControl, defaultCacheControl; got != want {
+					tb.Errorf("expected %q to be %q", got, want)
+				}
+				if got, want := w.Metadata[notBeforeKey], "1902902494"; got != want {
+					tb.Errorf("expected %q to be %q", got, want)
+				}
+				if got, want := w.PredefinedACL, ""; got != want {
+					tb.Errorf("expected %q to be %q", got, want)
+				}
+			},
+		},
+		{
+			name: "chunk_size_cache_control",
+			opts: []Option{
+				WithChunkSize(512 * 1024),
+				WithCacheControl("private, no-cache"),
+			},
+			check: func(tb testing.TB, w *storage.Writer) {
+				tb.Helper()
+
+				if got, want := w.ChunkSize, 512*1024; got != want {
+					tb.Errorf("expected %d to be %d", got, want)
+				}
+				if got, want := w.CacheControl, "private, no-cache"; got != want {
+					tb.Errorf("expected %q to be %q", got, want)
+				}
+			},
+		},
+		{
+			name: "disable_compression",
+			opts: []Option{
+				WithCacheControl("private"),
+				WithDisableCompression(),
+			},
+			check: func(tb testing.TB, w *storage.Writer) {
+				tb.Helper()
+
+				if got, want := w.ContentEncoding, "identity"; got != want {
+					tb.Errorf("expected %q to be %q", got, want)
+				}
+				if got, want := w.ContentType, "application/octet-stream"; got != want {
+					tb.Errorf("expected %q to be %q", got, want)
+				}
+				if got, want := w.CacheControl, "private, no-transform"; got != want {
+					tb.Errorf("expected %q to be %q", got, want)
+				}
+				if !w.SendCRC32C {
+					tb.Errorf("expected SendCRC32C to be true")
+				}
+			},
+		},
+		{
+			name: "disable_compression_defaults",
+			opts: []Option{
+				WithDisableCompression(),
+			},
+			check: func(tb testing.TB, w *storage.Writer) {
+				tb.Helper()
+
+				if got, want := w.CacheControl, defaultCacheControl; got != want {
+					tb.Errorf("expected %q to be %q", got, want)
+				}
+			},
+		},
+		{
+			// The fake server does not implement CMEK, so this only verifies that
+			// the key is passed to the writer.
+			name: "kms_key",
+			opts: []Option{
+				WithKMSKey("projects/p/locations/l/keyRings/r/cryptoKeys/k"),
+			},
+			check: func(tb testing.TB, w *storage.Writer) {
+				tb.Helper()
+
+				if got, want := w.KMSKeyName, "projects/p/locations/l/keyRings/r/cryptoKeys/k"; got != want {
+					tb.Errorf("expected %q to be %q", got, want)
+				}
+			},
+		},
+		{
+			name: "storage_class",
+			opts: []Option{
+				WithStorageClass("standard"),
+			},
+			check: func(tb testing.TB, w *storage.Writer) {
+				tb.Helper()
+
+				if got, want := w.StorageClass, "STANDARD"; got != want {
+					tb.Errorf("expected %q to be %q", got, want)
+				}
+			},
+		},
+		{
+			name: "predefined_acl",
+			opts: []Option{
+				WithPredefinedACL("projectPrivate"),
+			},
+			check: func(tb testing.TB, w *storage.Writer) {
+				tb.Helper()
+
+				if got, want := w.PredefinedACL, "projectPrivate"; got != want {
+					tb.Errorf("expected %q to be %q", got, want)
+				}
+			},
+		},
+		{
+			name: "no_auto_delete",
+			check: func(tb testing.TB, w *storage.Writer) {
+				tb.Helper()
+
+				if got := w.CustomTime; !got.IsZero() {
+					tb.Errorf("expected %s to be zero", got)
+				}
+			},
+		},
+		{
+			name: "auto_delete_after",
+			opts: []Option{
+				WithAutoDeleteAfter(24 * time.Hour),
+			},
+			check: func(tb testing.TB, w *storage.Writer) {
+				tb.Helper()
+
+				if got, want := w.CustomTime, nbf.Add(24*time.Hour); !got.Equal(want) {
+					tb.Errorf("expected %s to be %s", got, want)
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			lock := newTestLock(t, newTestServer(t), tc.opts...)
+			w := lock.newWriter(ctx, lock.client.Bucket(lock.bucket).Object(lock.object), nbf, newToken())
+			tc.check(t, w)
+		})
+	}
+}
+
+func TestGCSLock_Acquire_bodyWriter(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer,
+		WithOwner("worker-1"),
+		WithBodyWriter(func(w io.Writer, info LockInfo) error {
+			return json.NewEncoder(w).Encode(map[string]string{
+				"holder": info.Owner,
+				"expiry": info.NotBefore.Format(time.RFC3339),
+			})
+		}))
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	readBody := func(tb testing.TB) map[string]string {
+		tb.Helper()
+
+		r, err := gcsServer.Client().Bucket("my-bucket").Object("my-object").NewReader(ctx)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		defer r.Close()
+
+		var body map[string]string
+		if err := json.NewDecoder(r).Decode(&body); err != nil {
+			tb.Fatal(err)
+		}
+		return body
+	}
+
+	body := readBody(t)
+	if got, want := body["holder"], "worker-1"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// The body is rewritten on renewal.
+	if err := lock.Renew(ctx, 2*ttl); err != nil {
+		t.Fatal(err)
+	}
+	info, err := lock.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readBody(t)["expiry"], info.NotBefore.Format(time.RFC3339); got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestGCSLock_Acquire_bodyWriterError(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer, WithBodyWriter(func(_ io.Writer, _ LockInfo) error {
+		return fmt.Errorf("oops")
+	}))
+
+	checkErr(t, lock.Acquire(ctx, 5*time.Minute), "failed to write lock body: oops")
+	if _, err := gcsServer.Client().Bucket("my-bucket").Object("my-object").Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("expected object to not exist, got %v", err)
+	}
+}
+
+func TestWithStorageClass(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	_, err := NewWithOptions(ctx, "my-bucket", "my-object", WithStorageClass("FROZEN"))
+	checkErr(t, err, `storage class "FROZEN" is not a known storage class`)
+
+	// The fake server does not record the storage class of uploads, so check
+	// that it is read back from the attributes directly.
+	info, err := ParseLockInfo(&storage.ObjectAttrs{
+		Name:         "my-object",
+		StorageClass: "NEARLINE",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.StorageClass, "NEARLINE"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestWithPredefinedACL(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		acl  string
+		err  string
+	}{
+		{
+			name: "project_private",
+			acl:  "projectPrivate",
+		},
+		{
+			name: "public_read",
+			acl:  "publicRead",
+			err:  "would expose the lock object",
+		},
+		{
+			name: "authenticated_read",
+			acl:  "authenticatedRead",
+			err:  "would expose the lock object",
+		},
+		{
+			name: "unknown",
+			acl:  "project-private",
+			err:  "is not a known predefined acl",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			checkErr(t, WithPredefinedACL(tc.acl)(new(Lock)), tc.err)
+		})
+	}
+}
+
+func TestWithChunkSize(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewWithOptions(context.Background(), "my-bucket", "my-object", WithChunkSize(-1)); err == nil {
+		t.Errorf("expected error, got nothing")
+	}
+}
+
+func TestNewWithOptions_invalidNames(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	_, err := NewWithOptions(ctx, "My_Bucket", "my-object")
+	checkErr(t, err, `invalid bucket: bucket name "My_Bucket"`)
+
+	_, err = NewWithOptions(ctx, "my-bucket", "/my-object")
+	checkErr(t, err, `invalid object: object name "/my-object"`)
+}
+
+func TestWithRetryJitterPercent(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	_, err := NewWithOptions(ctx, "my-bucket", "my-object", WithRetryJitterPercent(101))
+	checkErr(t, err, "must be between 0 and 100")
+
+	lock := newTestLock(t, newTestServer(t), WithRetryJitterPercent(0))
+	if got, want := lock.retryJitterPercent, uint64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got := lock.retryPolicy; got == nil {
+		t.Errorf("expected retryPolicy to be defined")
+	}
+}
+
+// first returns the first of two values.
+func first[T, U any](v T, _ U) T {
+	return v
+}
+
+func TestWithExponentialBackoff(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	_, err := NewWithOptions(ctx, "my-bucket", "my-object", WithExponentialBackoff(time.Second, time.Millisecond, 3))
+	checkErr(t, err, "must be at least the base")
+
+	lock := newTestLock(t, newTestServer(t),
+		WithRetryJitterPercent(0),
+		WithExponentialBackoff(10*time.Millisecond, 40*time.Millisecond, 4))
+
+	var got []time.Duration
+	policy := lock.retryPolicy()
+	for {
+		next, stop := policy.Next()
+		if stop {
+			break
+		}
+		got = append(got, next)
+	}
+
+	if got, want := fmt.Sprint(got), "[10ms 20ms 40ms 40ms]"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestGCSLock_requestContext(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	lock := newTestLock(t, newTestServer(t))
+	if got := callctx.HeadersFromContext(lock.requestContext(ctx)); len(got) != 0 {
+		t.Errorf("expected no headers, got %v", got)
+	}
+
+	lock = newTestLock(t, newTestServer(t), WithRequestReason("my-service"))
+	headers := callctx.HeadersFromContext(lock.requestContext(ctx))
+	if got, want := headers[requestReasonHeader], []string{"my-service"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// Writes still succeed with the header attached.
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// uploadHeaderTransport records the values of a header on uploads.
+type uploadHeaderTransport struct {
+	base   http.RoundTripper
+	header string
+
+	mu     sync.Mutex
+	values [][]string
+}
+
+func (t *uploadHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasPrefix(req.URL.Path, "/upload/") {
+		t.mu.Lock()
+		t.values = append(t.values, req.Header.Values(t.header))
+		t.mu.Unlock()
+	}
+	return t.base.RoundTrip(req)
+}
+
+func TestGCSLock_idempotencyKey(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+
+	// The transport sees the final headers, beneath the storage client.
+	transport := &uploadHeaderTransport{base: gcsServer.HTTPClient().Transport, header: idempotencyTokenHeader}
+	lock, err := NewWithOptions(ctx, "my-bucket", "my-object",
+		WithHTTPClient(&http.Client{Transport: transport}),
+		WithIdempotencyKey("my-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := lock.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if _, err := lock.AcquireLease(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(transport.values), 1; got != want {
+		t.Fatalf("expected %d uploads to be %d", got, want)
+	}
+	if got, want := transport.values[0], []string{"my-key-" + lock.lastToken()}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// A second lease is written with a new idempotency token.
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lock.AcquireLease(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(transport.values), 2; got != want {
+		t.Fatalf("expected %d uploads to be %d", got, want)
+	}
+	if got, want := transport.values[1], []string{"my-key-" + lock.lastToken()}; len(got) != 1 || got[0] != want[0] || got[0] == transport.values[0][0] {
+		t.Errorf("expected %q to be %q and not %q", got, want, transport.values[0])
+	}
+
+	// Without a custom HTTP client, one is built with default credentials.
+	other, err := NewWithOptions(ctx, "my-bucket", "my-object", WithIdempotencyKey("my-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// lostResponseTransport passes the first upload through, but replaces its
+// response with an error, as if the response was lost after the write
+// succeeded.
+type lostResponseTransport struct {
+	base http.RoundTripper
+	lost atomic.Bool
+}
+
+func (t *lostResponseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.Path, "/upload/") || t.lost.Swap(true) {
+		return t.base.RoundTrip(req)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	return &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"error":{"code":503,"message":"unavailable"}}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestGCSLock_idempotencyKey_retry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+
+	lost := &lostResponseTransport{base: gcsServer.HTTPClient().Transport}
+	transport := &uploadHeaderTransport{base: lost, header: idempotencyTokenHeader}
+	lock, err := NewWithOptions(ctx, "my-bucket", "my-object",
+		WithHTTPClient(&http.Client{Transport: transport}),
+		WithIdempotencyKey("my-key"),
+		WithSkipPreRead(),
+		WithStorageRetry(storage.WithPolicy(storage.RetryNever)),
+		WithRetryJitterPercent(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := lock.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// The write succeeds, but its response is lost, so gcslock re-issues it
+	// with the same token and then adopts the lease it already wrote.
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(transport.values), 2; got != want {
+		t.Fatalf("expected %d uploads to be %d", got, want)
+	}
+	if got, want := transport.values[1], transport.values[0]; len(got) != 1 || len(want) != 1 || got[0] != want[0] {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := transport.values[0], []string{"my-key-" + lock.lastToken()}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := first(lock.LastGeneration()), objectGeneration(t, gcsServer); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := lock.Stats().Retries, int64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestWithIdempotencyKey(t *testing.T) {
+	t.Parallel()
+
+	checkErr(t, WithIdempotencyKey("")(new(Lock)), "cannot be empty")
+}
+
+func TestGCSLock_storageRetry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	lock := newTestLock(t, newTestServer(t),
+		WithStorageRetry(storage.WithPolicy(storage.RetryAlways)),
+		WithStorageRetry(storage.WithBackoff(gax.Backoff{Initial: time.Millisecond})))
+	if got, want := len(lock.storageRetryOpts), 2; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCSLock_retry_onRetry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	var attempts []int
+	var errs []string
+	lock := newTestLock(t, newTestServer(t), WithOnRetry(func(attempt int, err error) {
+		attempts = append(attempts, attempt)
+		errs = append(errs, err.Error())
+	}))
+
+	var calls int
+	if err := lock.retry(ctx, func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return retry.RetryableError(fmt.Errorf("attempt %d failed", calls))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := fmt.Sprint(attempts), "[1 2]"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := strings.Join(errs, ","), "attempt 1 failed,attempt 2 failed"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestGCSLock_retry_freshPolicy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	lock := newTestLock(t, newTestServer(t),
+		WithRetryJitterPercent(0),
+		WithExponentialBackoff(time.Millisecond, time.Millisecond, 2))
+
+	// Each call gets its own retry budget, even after an earlier call used up
+	// all of its retries.
+	for i := 0; i < 2; i++ {
+		if got, want := retryAttempts(ctx, t, lock), 3; got != want {
+			t.Errorf("call %d: expected %d attempts to be %d", i, got, want)
+		}
+	}
+}
+
+// retryAttempts runs an operation that always fails with a retryable error
+// through the retry policy of the lock, and returns the number of attempts.
+func retryAttempts(ctx context.Context, tb testing.TB, lock *Lock) int {
+	tb.Helper()
+
+	var calls int
+	if err := lock.retry(ctx, func(ctx context.Context) error {
+		calls++
+		return retry.RetryableError(fmt.Errorf("attempt %d failed", calls))
+	}); err == nil {
+		tb.Fatal("expected error")
+	}
+	return calls
+}
+
+func TestRetryThrottled(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{
+			name: "not_api_error",
+			err:  errors.New("oops"),
+		},
+		{
+			name: "forbidden",
+			err:  &googleapi.Error{Code: http.StatusForbidden},
+		},
+		{
+			name:      "too_many_requests",
+			err:       &googleapi.Error{Code: http.StatusTooManyRequests},
+			retryable: true,
+		},
+		{
+			name: "service_unavailable_retry_after",
+			err: &googleapi.Error{
+				Code:   http.StatusServiceUnavailable,
+				Header: http.Header{"Retry-After": []string{"0"}},
+			},
+			retryable: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := retryThrottled(ctx, tc.err)
+			if got, want := err != nil, tc.retryable; got != want {
+				t.Fatalf("expected retryable to be %t, got %v", want, err)
+			}
+			if err != nil && !errors.Is(err, tc.err) {
+				t.Errorf("expected %v to wrap %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1902902494, 0).UTC()
+
+	cases := []struct {
+		name string
+		in   string
+		exp  time.Duration
+	}{
+		{
+			name: "empty",
+			in:   "",
+			exp:  0,
+		},
+		{
+			name: "seconds",
+			in:   "3",
+			exp:  3 * time.Second,
+		},
+		{
+			name: "negative",
+			in:   "-3",
+			exp:  0,
+		},
+		{
+			name: "date",
+			in:   now.Add(5 * time.Second).Format(http.TimeFormat),
+			exp:  5 * time.Second,
+		},
+		{
+			name: "date_past",
+			in:   now.Add(-5 * time.Second).Format(http.TimeFormat),
+			exp:  0,
+		},
+		{
+			name: "invalid",
+			in:   "banana",
+			exp:  0,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := parseRetryAfter(tc.in, now), tc.exp; got != want {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_notBefore(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1902902494, 0).UTC()
+
+	cases := []struct {
+		name    string
+		roundUp bool
+		now     time.Time
+		ttl     time.Duration
+		exp     time.Time
+	}{
+		{
+			name: "truncate_exact",
+			now:  now,
+			ttl:  5 * time.Second,
+			exp:  now.Add(5 * time.Second),
+		},
+		{
+			name: "truncate_fractional",
+			now:  now.Add(900 * time.Millisecond),
+			ttl:  5*time.Second + 900*time.Millisecond,
+			exp:  now.Add(5 * time.Second),
+		},
+		{
+			name:    "round_up_exact",
+			roundUp: true,
+			now:     now,
+			ttl:     5 * time.Second,
+			exp:     now.Add(5 * time.Second),
+		},
+		{
+			name:    "round_up_fractional",
+			roundUp: true,
+			now:     now.Add(900 * time.Millisecond),
+			ttl:     5*time.Second + 900*time.Millisecond,
+			exp:     now.Add(7 * time.Second),
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			lock := &Lock{ttlRoundUp: tc.roundUp}
+			if got, want := lock.notBefore(tc.now, tc.ttl), tc.exp; !got.Equal(want) {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_objectTemplate(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer, WithObjectTemplate(func(t time.Time) string {
+		return "locks/" + t.Format(time.DateOnly) + "/leader"
+	}))
+
+	now := time.Date(2024, 1, 15, 23, 59, 0, 0, time.UTC)
+	lock.nowFunc = func() time.Time { return now }
+
+	if got, want := lock.Object(), "locks/2024-01-15/leader"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next day, a different object is used, even though the previous lease
+	// has not expired.
+	now = now.Add(2 * time.Minute)
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := lock.Object(), "locks/2024-01-16/leader"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := gcsServer.Client().Bucket("my-bucket")
+	if _, err := bucket.Object("locks/2024-01-15/leader").Attrs(ctx); err != nil {
+		t.Errorf("expected previous lock to exist: %s", err)
+	}
+	if _, err := bucket.Object("locks/2024-01-16/leader").Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("expected %v to be %v", err, storage.ErrObjectNotExist)
+	}
+
+	// Invalid names are rejected.
+	invalid := newTestLock(t, gcsServer, WithObjectTemplate(func(time.Time) string { return "" }))
+	err := invalid.Acquire(ctx, ttl)
+	checkErr(t, err, "invalid object from template")
 }
@@ -0,0 +1,169 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gcslocktest provides helpers for testing code that depends on
+// gcslock without talking to Google Cloud Storage.
+package gcslocktest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sethvargo/go-gcslock"
+)
+
+// Verify that the FakeLock implements the interface.
+var _ gcslock.Lockable = (*FakeLock)(nil)
+
+// FakeLock is an in-memory implementation of [gcslock.Lockable]. By default it
+// honors the same TTL semantics as [gcslock.Lock]: acquiring succeeds when the
+// lock is unheld or expired, and returns a [*gcslock.LockHeldError] while a
+// previous lease is still valid. The behavior can be overridden to always
+// succeed, to appear held until a fixed time, or to return an error.
+//
+// It is safe for concurrent use. The zero value is ready to use.
+type FakeLock struct {
+	mu sync.Mutex
+
+	now           func() time.Time
+	nbf           time.Time
+	heldUntil     time.Time
+	alwaysSucceed bool
+	acquireErr    error
+	closeErr      error
+
+	acquireCalls int
+	closeCalls   int
+}
+
+// NewFakeLock creates a new fake lock that is not held.
+func NewFakeLock() *FakeLock {
+	return &FakeLock{}
+}
+
+// SetNow overrides the clock used to evaluate TTLs. This is useful for testing
+// renewal and expiry without sleeping. A nil function restores the system
+// clock.
+func (f *FakeLock) SetNow(fn func() time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = fn
+}
+
+// SetHeldUntil makes the lock appear held by someone else until the given
+// time, regardless of any leases acquired through this fake. A zero time
+// clears the override.
+func (f *FakeLock) SetHeldUntil(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.heldUntil = t
+}
+
+// SetAlwaysSucceed makes every call to Acquire succeed, even when a lease is
+// still valid.
+func (f *FakeLock) SetAlwaysSucceed(v bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.alwaysSucceed = v
+}
+
+// SetAcquireError makes every call to Acquire return the given error. A nil
+// error clears the override.
+func (f *FakeLock) SetAcquireError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.acquireErr = err
+}
+
+// SetCloseError makes every call to Close return the given error. A nil error
+// clears the override.
+func (f *FakeLock) SetCloseError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closeErr = err
+}
+
+// AcquireCalls returns the number of times Acquire has been called.
+func (f *FakeLock) AcquireCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.acquireCalls
+}
+
+// CloseCalls returns the number of times Close has been called.
+func (f *FakeLock) CloseCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closeCalls
+}
+
+// NotBefore returns the expiration of the last lease acquired through this
+// fake, or the zero time if no lease has been acquired.
+func (f *FakeLock) NotBefore() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nbf
+}
+
+// Acquire implements [gcslock.Lockable].
+func (f *FakeLock) Acquire(ctx context.Context, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.acquireCalls++
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if f.acquireErr != nil {
+		return f.acquireErr
+	}
+
+	if ttl < time.Second {
+		return fmt.Errorf("failed to acquire lock: ttl %s must be at least 1s", ttl)
+	}
+
+	now := time.Now()
+	if f.now != nil {
+		now = f.now()
+	}
+	now = now.UTC().Truncate(time.Second)
+	ttl = ttl.Truncate(time.Second)
+
+	if !f.alwaysSucceed {
+		held := f.nbf
+		if f.heldUntil.After(held) {
+			held = f.heldUntil
+		}
+
+		if !held.IsZero() && held.Unix() >= now.Unix() {
+			return gcslock.NewLockHeldError(held.Unix())
+		}
+	}
+
+	f.nbf = now.Add(ttl)
+	return nil
+}
+
+// Close implements [gcslock.Lockable].
+func (f *FakeLock) Close(_ context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closeCalls++
+	return f.closeErr
+}
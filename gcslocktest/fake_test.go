@@ -0,0 +1,144 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslocktest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-gcslock"
+)
+
+func TestFakeLock_Acquire(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	now := time.Unix(1902902494, 0).UTC()
+	ttl := 5 * time.Minute
+
+	cases := []struct {
+		name    string
+		setup   func(f *FakeLock)
+		offsets []time.Duration
+		errs    []string
+	}{
+		{
+			name:    "acquire_then_held",
+			offsets: []time.Duration{0, ttl / 2},
+			errs:    []string{"", "lock held until 2030-04-20T08:06:34Z"},
+		},
+		{
+			name:    "acquire_after_expiry",
+			offsets: []time.Duration{0, ttl + time.Second},
+			errs:    []string{"", ""},
+		},
+		{
+			name: "held_until",
+			setup: func(f *FakeLock) {
+				f.SetHeldUntil(now.Add(time.Minute))
+			},
+			offsets: []time.Duration{0, 2 * time.Minute},
+			errs:    []string{"lock held until 2030-04-20T08:02:34Z", ""},
+		},
+		{
+			name: "always_succeed",
+			setup: func(f *FakeLock) {
+				f.SetAlwaysSucceed(true)
+			},
+			offsets: []time.Duration{0, 0},
+			errs:    []string{"", ""},
+		},
+		{
+			name: "error",
+			setup: func(f *FakeLock) {
+				f.SetAcquireError(errors.New("oops"))
+			},
+			offsets: []time.Duration{0},
+			errs:    []string{"oops"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f := NewFakeLock()
+			if tc.setup != nil {
+				tc.setup(f)
+			}
+
+			for i, offset := range tc.offsets {
+				offset := offset
+				f.SetNow(func() time.Time { return now.Add(offset) })
+
+				err := f.Acquire(ctx, ttl)
+				if got, want := errString(err), tc.errs[i]; got != want {
+					t.Errorf("attempt %d: expected %q to be %q", i, got, want)
+				}
+			}
+
+			if got, want := f.AcquireCalls(), len(tc.offsets); got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestFakeLock_LockHeldError(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	f := NewFakeLock()
+	f.SetHeldUntil(time.Now().Add(time.Hour))
+
+	err := f.Acquire(ctx, time.Minute)
+
+	var lockErr *gcslock.LockHeldError
+	if !errors.As(err, &lockErr) {
+		t.Fatalf("expected %s (%T) to be %T", err, err, lockErr)
+	}
+}
+
+func TestFakeLock_Close(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	f := NewFakeLock()
+	if err := f.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	f.SetCloseError(errors.New("oops"))
+	if got, want := errString(f.Close(ctx)), "oops"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	if got, want := f.CloseCalls(), 2; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
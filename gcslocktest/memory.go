@@ -0,0 +1,104 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslocktest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sethvargo/go-gcslock"
+)
+
+// Verify that the InMemoryLock implements the interface.
+var _ gcslock.Lockable = (*InMemoryLock)(nil)
+
+// InMemoryStore holds the leases for a set of in-memory locks, keyed by name.
+// Locks returned by the same store with the same name contend with each other,
+// like [gcslock.Lock] instances on the same object. It is safe for concurrent
+// use.
+type InMemoryStore struct {
+	mu     sync.Mutex
+	epoch  time.Time
+	leases map[string]time.Time
+}
+
+// NewInMemoryStore creates a new store with no leases.
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{
+		epoch:  time.Now(),
+		leases: make(map[string]time.Time),
+	}
+}
+
+// Lock returns a lock with the given name in the store.
+func (s *InMemoryStore) Lock(name string) *InMemoryLock {
+	return &InMemoryLock{
+		store: s,
+		name:  name,
+	}
+}
+
+// now returns the current time as measured by the monotonic clock since the
+// store was created, so that changes to the wall clock do not affect leases.
+func (s *InMemoryStore) now() time.Time {
+	return s.epoch.Add(time.Since(s.epoch)).UTC()
+}
+
+// InMemoryLock is a [gcslock.Lockable] that keeps its lease in memory instead
+// of in Google Cloud Storage, for fast tests of code that coordinates through
+// a lock. Unlike [FakeLock], it cannot be configured; it is a reference
+// implementation of the same TTL semantics as [gcslock.Lock], including the
+// truncation of times to the second. It is safe for concurrent use.
+type InMemoryLock struct {
+	store *InMemoryStore
+	name  string
+}
+
+// NewInMemoryLock creates a new in-memory lock that is not held, backed by its
+// own [InMemoryStore].
+func NewInMemoryLock() *InMemoryLock {
+	return NewInMemoryStore().Lock("")
+}
+
+// Acquire implements [gcslock.Lockable]. It returns a [*gcslock.LockHeldError]
+// while a previous lease on the same name is still valid.
+func (l *InMemoryLock) Acquire(ctx context.Context, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+
+	if ttl < time.Second {
+		return fmt.Errorf("failed to acquire lock: ttl %s must be at least 1s", ttl)
+	}
+
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+
+	now := l.store.now().Truncate(time.Second)
+	if nbf, ok := l.store.leases[l.name]; ok && nbf.Unix() >= now.Unix() {
+		return fmt.Errorf("failed to acquire lock: %w", gcslock.NewLockHeldError(nbf.Unix()))
+	}
+
+	l.store.leases[l.name] = now.Add(ttl.Truncate(time.Second))
+	return nil
+}
+
+// Close implements [gcslock.Lockable]. Like [gcslock.Lock.Close], it does not
+// release the lease.
+func (l *InMemoryLock) Close(_ context.Context) error {
+	return nil
+}
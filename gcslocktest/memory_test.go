@@ -0,0 +1,83 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslocktest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-gcslock"
+)
+
+func TestInMemoryLock_Acquire(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	store := NewInMemoryStore()
+	a, b := store.Lock("my-object"), store.Lock("my-object")
+
+	if err := a.Acquire(ctx, 500*time.Millisecond); err == nil {
+		t.Error("expected error for sub-second ttl")
+	}
+
+	if err := a.Acquire(ctx, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	var lockErr *gcslock.LockHeldError
+	if err := b.Acquire(ctx, time.Second); !errors.As(err, &lockErr) {
+		t.Fatalf("expected %v to be a LockHeldError", err)
+	}
+
+	// Other names are independent.
+	if err := store.Lock("other").Acquire(ctx, time.Second); err != nil {
+		t.Error(err)
+	}
+
+	// The lease is held through the second containing its expiration.
+	time.Sleep(time.Until(lockErr.NotBefore().Add(time.Second)))
+	if err := b.Acquire(ctx, time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInMemoryLock_concurrent(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	lock := NewInMemoryLock()
+
+	var acquired atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := lock.Acquire(ctx, time.Minute); err == nil {
+				acquired.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := acquired.Load(), int32(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
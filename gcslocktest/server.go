@@ -0,0 +1,49 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslocktest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"google.golang.org/api/option"
+)
+
+// NewFakeServer starts an in-memory Google Cloud Storage server with the given
+// buckets, and stops it when the test finishes. It returns the server and a
+// client option that directs a storage client to it, which can be passed to
+// [gcslock.New] to create a real lock that never talks to Google Cloud:
+//
+//	srv, opt := gcslocktest.NewFakeServer(t, "my-bucket")
+//	lock, err := gcslock.New(ctx, "my-bucket", "my-object", opt)
+//
+// The server can be used to inspect or modify the lock objects directly.
+func NewFakeServer(tb testing.TB, buckets ...string) (*fakestorage.Server, option.ClientOption) {
+	tb.Helper()
+
+	srv := fakestorage.NewServer(nil)
+	tb.Cleanup(srv.Stop)
+
+	for _, bucket := range buckets {
+		if err := srv.Client().Bucket(bucket).Create(context.Background(), "gcslocktest", nil); err != nil {
+			tb.Fatalf("failed to create bucket %q: %s", bucket, err)
+		}
+	}
+
+	// The server's HTTP client routes every request to the server, so no
+	// endpoint or credentials are needed.
+	return srv, option.WithHTTPClient(srv.HTTPClient())
+}
@@ -0,0 +1,54 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslocktest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-gcslock"
+)
+
+func TestNewFakeServer(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	srv, opt := NewFakeServer(t, "my-bucket")
+
+	lock, err := gcslock.New(ctx, "my-bucket", "my-object", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := lock.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Acquire(ctx, 5*time.Minute); !errors.Is(err, gcslock.ErrLockHeld) {
+		t.Errorf("expected %v to be %v", err, gcslock.ErrLockHeld)
+	}
+
+	// The lock object is visible on the server.
+	if _, err := srv.Client().Bucket("my-bucket").Object("my-object").Attrs(ctx); err != nil {
+		t.Error(err)
+	}
+}
@@ -7,8 +7,10 @@ toolchain go1.22.2
 require (
 	cloud.google.com/go/storage v1.40.0
 	github.com/fsouza/fake-gcs-server v1.48.0
+	github.com/googleapis/gax-go/v2 v2.12.3
 	github.com/sethvargo/go-retry v0.2.4
 	google.golang.org/api v0.174.0
+	google.golang.org/grpc v1.63.2
 )
 
 require (
@@ -27,7 +29,6 @@ require (
 	github.com/google/s2a-go v0.1.7 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/googleapis/enterprise-certificate-proxy v0.3.2 // indirect
-	github.com/googleapis/gax-go/v2 v2.12.3 // indirect
 	github.com/gorilla/handlers v1.5.2 // indirect
 	github.com/gorilla/mux v1.8.1 // indirect
 	github.com/pkg/xattr v0.4.9 // indirect
@@ -47,6 +48,5 @@ require (
 	google.golang.org/genproto v0.0.0-20240415180920-8c6c420018be // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20240415180920-8c6c420018be // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240415180920-8c6c420018be // indirect
-	google.golang.org/grpc v1.63.2 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
 )
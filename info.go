@@ -0,0 +1,360 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// LockInfo describes the state of a lock object as stored in Google Cloud
+// Storage.
+type LockInfo struct {
+	// Object is the name of the lock object.
+	Object string
+
+	// NotBefore is the time at which the lock expires. It is the zero time if
+	// the lock object does not exist.
+	NotBefore time.Time
+
+	// Generation and Metageneration are the generation and metageneration of
+	// the lock object. They are zero if the lock object does not exist.
+	Generation     int64
+	Metageneration int64
+
+	// Owner is the owner of the lease, as set with [WithOwner]. It is empty if
+	// no owner was recorded.
+	Owner string
+
+	// StorageClass is the storage class of the lock object, such as STANDARD.
+	// It is empty if the lock object does not exist.
+	StorageClass string
+
+	// AcquiredAt is the time at which the current lease was first acquired, as
+	// recorded with [WithTrackAcquiredAt]. Renewals do not change it, so the
+	// difference from now is how long the holder has held the lock. It is the
+	// zero time if no acquisition time was recorded.
+	AcquiredAt time.Time
+
+	// Metadata is the user-provided metadata on the lock object, such as the
+	// values set with [WithMetadata]. Keys reserved by gcslock are omitted.
+	Metadata map[string]string
+}
+
+// HeldAt returns true if the lock is held at the given time.
+func (i *LockInfo) HeldAt(t time.Time) bool {
+	if i == nil || i.Generation == 0 {
+		return false
+	}
+	return i.NotBefore.Unix() >= t.Unix()
+}
+
+// clone returns a deep copy of the info.
+func (i *LockInfo) clone() *LockInfo {
+	c := *i
+	if i.Metadata != nil {
+		c.Metadata = make(map[string]string, len(i.Metadata))
+		for k, v := range i.Metadata {
+			c.Metadata[k] = v
+		}
+	}
+	return &c
+}
+
+// Info reads the current state of the lock object. It does not modify the
+// object. If the lock object does not exist, it returns a LockInfo with a zero
+// Generation.
+//
+// If the lock was created with [WithStateCache], the result may be served from
+// the cache.
+func (l *Lock) Info(ctx context.Context) (*LockInfo, error) {
+	ctx = l.resolveContext(ctx)
+
+	if l.stateCacheTTL <= 0 {
+		return l.readInfo(ctx)
+	}
+
+	now := l.now()
+
+	l.state.mu.Lock()
+	if cached := l.state.cachedInfo; cached != nil && now.Before(l.state.cachedAt.Add(l.stateCacheTTL)) {
+		info := cached.clone()
+		l.state.mu.Unlock()
+		return info, nil
+	}
+	l.state.mu.Unlock()
+
+	info, err := l.readInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	l.state.mu.Lock()
+	l.state.cachedInfo = info.clone()
+	l.state.cachedAt = now
+	l.state.mu.Unlock()
+
+	return info, nil
+}
+
+// readInfo reads the current state of the lock object, bypassing the cache.
+func (l *Lock) readInfo(ctx context.Context) (*LockInfo, error) {
+	opCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	attrs, err := l.objectHandle().Attrs(opCtx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return &LockInfo{Object: l.objectName()}, nil
+		}
+		return nil, fmt.Errorf("failed to get storage object: %w", err)
+	}
+	return ParseLockInfo(attrs)
+}
+
+// Metadata returns a copy of all metadata on the lock object, including the
+// keys reserved by gcslock and anything stored by other writers, without
+// parsing it. It is intended for debugging; use [Lock.Info] for the parsed
+// state. It always reads the object, even if [WithStateCache] is configured.
+// If the object exists but has no metadata, it returns an empty map. If the
+// object does not exist, it returns [ErrLockGone].
+func (l *Lock) Metadata(ctx context.Context) (map[string]string, error) {
+	ctx = l.resolveContext(ctx)
+
+	opCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	attrs, err := l.objectHandle().Attrs(opCtx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, fmt.Errorf("failed to get lock metadata: %w", ErrLockGone)
+		}
+		return nil, fmt.Errorf("failed to get lock metadata: %w", err)
+	}
+
+	metadata := make(map[string]string, len(attrs.Metadata))
+	for k, v := range attrs.Metadata {
+		metadata[k] = v
+	}
+	return metadata, nil
+}
+
+// ListLocks returns the state of every lock object in the bucket whose name
+// starts with prefix, in lexicographic order. It is a read-only management
+// utility for auditing locks, for example to find stale shards, and does not
+// require a [Lock]. It pages through all matching objects, so callers should
+// use a narrow prefix in buckets that contain unrelated objects.
+//
+// Objects whose state cannot be parsed, such as corrupt locks, are skipped
+// rather than failing the whole listing. In that case the locks that could be
+// parsed are still returned, along with an error naming each object skipped.
+func ListLocks(ctx context.Context, client *storage.Client, bucket, prefix string) ([]LockInfo, error) {
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+
+	var infos []LockInfo
+	var parseErrs []error
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			if errors.Is(err, storage.ErrBucketNotExist) {
+				return nil, fmt.Errorf("failed to list locks: %w", NewBucketNotFoundError(bucket))
+			}
+			return nil, fmt.Errorf("failed to list locks: %w", err)
+		}
+
+		info, err := ParseLockInfo(attrs)
+		if err != nil {
+			parseErrs = append(parseErrs, fmt.Errorf("failed to parse lock %q: %w", attrs.Name, err))
+			continue
+		}
+		infos = append(infos, *info)
+	}
+
+	if len(parseErrs) > 0 {
+		return infos, fmt.Errorf("failed to list %d locks: %w", len(parseErrs), errors.Join(parseErrs...))
+	}
+	return infos, nil
+}
+
+// DeleteLock unconditionally deletes the lock object, regardless of who holds
+// it or whether the lease has expired. It is a privileged management utility
+// for incident response and does not require a [Lock]. Processes that believed
+// they held the lock are not notified, and later renewals or releases by them
+// return a [*NotLockOwnerError]. To give up a lease held by this process, use
+// [Lock.Release] instead. If the object does not exist, it returns nil.
+func DeleteLock(ctx context.Context, client *storage.Client, bucket, object string) error {
+	if err := validateBucketName(bucket); err != nil {
+		return fmt.Errorf("failed to delete lock: %w", err)
+	}
+	if err := validateObjectName(object); err != nil {
+		return fmt.Errorf("failed to delete lock: %w", err)
+	}
+
+	if err := client.Bucket(bucket).Object(object).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("failed to delete lock: %w", err)
+	}
+	return nil
+}
+
+// ParseLockInfo interprets the attributes of a lock object, such as those
+// returned by a caller's own listing, without needing a [Lock]. It returns an
+// error if the attributes are nil or the stored expiration is invalid.
+func ParseLockInfo(attrs *storage.ObjectAttrs) (*LockInfo, error) {
+	if attrs == nil {
+		return nil, fmt.Errorf("object attributes cannot be nil")
+	}
+
+	nbf, err := parseNotBefore(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]string, len(attrs.Metadata))
+	for k, v := range attrs.Metadata {
+		if !isReservedMetadataKey(k) {
+			metadata[k] = v
+		}
+	}
+
+	return &LockInfo{
+		Object:         attrs.Name,
+		NotBefore:      time.Unix(nbf, 0).UTC(),
+		Generation:     attrs.Generation,
+		Metageneration: attrs.Metageneration,
+		Owner:          attrs.Metadata[ownerKey],
+		StorageClass:   attrs.StorageClass,
+		AcquiredAt:     parseAcquiredAt(attrs),
+		Metadata:       metadata,
+	}, nil
+}
+
+// Held returns true if the lock is currently held by anyone, and false if the
+// lock object is missing or expired. It does not modify the object.
+func (l *Lock) Held(ctx context.Context) (bool, error) {
+	ctx = l.resolveContext(ctx)
+
+	info, err := l.Info(ctx)
+	if err != nil {
+		return false, err
+	}
+	return info.HeldAt(l.now()), nil
+}
+
+// HeldByMe returns true if this process currently holds the lock: the lock
+// object is still at the generation of our most recent write, and the lease has
+// not expired. Unlike [Lock.Held], it always reads the object, even if
+// [WithStateCache] is configured, so that it observes a takeover by another
+// process.
+func (l *Lock) HeldByMe(ctx context.Context) (bool, error) {
+	ctx = l.resolveContext(ctx)
+
+	generation, _ := l.LastGeneration()
+	if generation == 0 {
+		return false, nil
+	}
+
+	info, err := l.readInfo(ctx)
+	if err != nil {
+		return false, err
+	}
+	return info.Generation == generation && info.HeldAt(l.now()), nil
+}
+
+// RemainingTTL returns how long until the lock expires, or zero if the lock
+// object is missing or expired. It does not modify the object.
+func (l *Lock) RemainingTTL(ctx context.Context) (time.Duration, error) {
+	ctx = l.resolveContext(ctx)
+
+	info, err := l.Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now := l.now()
+	if !info.HeldAt(now) {
+		return 0, nil
+	}
+
+	if remaining := info.NotBefore.Sub(now); remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
+
+// Ping verifies that the bucket exists and is accessible with the configured
+// credentials. It is intended to surface misconfiguration at startup, and is
+// cheap enough to call from readiness probes. It reads the bucket metadata,
+// which requires the storage.buckets.get permission. If the bucket does not
+// exist, it returns a [*BucketNotFoundError].
+func (l *Lock) Ping(ctx context.Context) error {
+	ctx = l.resolveContext(ctx)
+
+	opCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	if _, err := l.client.Bucket(l.bucketName()).Attrs(opCtx); err != nil {
+		if errors.Is(err, storage.ErrBucketNotExist) {
+			return fmt.Errorf("failed to ping bucket: %w", NewBucketNotFoundError(l.bucketName()))
+		}
+		return fmt.Errorf("failed to ping bucket %q: %w", l.bucketName(), err)
+	}
+	return nil
+}
+
+// parseNotBefore returns the not-before Unix timestamp stored in the object
+// metadata. Both Unix seconds and RFC3339 timestamps are accepted, regardless
+// of how this lock is configured to write them. Objects without a timestamp are
+// treated as expired.
+func parseNotBefore(attrs *storage.ObjectAttrs) (int64, error) {
+	nbf, ok := attrs.Metadata[notBeforeKey]
+	if !ok {
+		nbf = "0"
+	}
+
+	nbfUnix, err := strconv.ParseInt(nbf, 10, 64)
+	if err != nil {
+		t, terr := time.Parse(time.RFC3339, nbf)
+		if terr != nil {
+			return 0, fmt.Errorf("failed to parse nbf %q as an integer or RFC3339 timestamp", nbf)
+		}
+		return t.Unix(), nil
+	}
+	return nbfUnix, nil
+}
+
+// parseAcquiredAt reads the acquired_at metadata from the object attributes. It
+// is informational only, so a missing or invalid value returns the zero time
+// rather than an error.
+func parseAcquiredAt(attrs *storage.ObjectAttrs) time.Time {
+	v, ok := attrs.Metadata[acquiredAtKey]
+	if !ok {
+		return time.Time{}
+	}
+
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
@@ -0,0 +1,536 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+func TestGCSLock_Held(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name string
+		nbf  time.Time
+		exp  bool
+	}{
+		{
+			name: "missing",
+			exp:  false,
+		},
+		{
+			name: "expired",
+			nbf:  time.Now().Add(-5 * time.Minute),
+			exp:  false,
+		},
+		{
+			name: "held",
+			nbf:  time.Now().Add(5 * time.Minute),
+			exp:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			gcsServer := newTestServer(t)
+			if !tc.nbf.IsZero() {
+				writeTestLock(t, gcsServer, tc.nbf)
+			}
+			lock := newTestLock(t, gcsServer)
+
+			held, err := lock.Held(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := held, tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+
+			info, err := lock.Info(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := info.NotBefore.Unix(), tc.nbf.Unix(); !tc.nbf.IsZero() && got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_RemainingTTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	now := time.Unix(1902902494, 0).UTC()
+
+	cases := []struct {
+		name string
+		nbf  time.Time
+		exp  time.Duration
+	}{
+		{
+			name: "missing",
+			exp:  0,
+		},
+		{
+			name: "expired",
+			nbf:  now.Add(-5 * time.Minute),
+			exp:  0,
+		},
+		{
+			name: "held",
+			nbf:  now.Add(5 * time.Minute),
+			exp:  5 * time.Minute,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			gcsServer := newTestServer(t)
+			if !tc.nbf.IsZero() {
+				writeTestLock(t, gcsServer, tc.nbf)
+			}
+			lock := newTestLock(t, gcsServer)
+			lock.nowFunc = func() time.Time { return now }
+
+			remaining, err := lock.RemainingTTL(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := remaining, tc.exp; got != want {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_Info_metadata(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	_, err := NewWithOptions(ctx, "my-bucket", "my-object", WithMetadata(map[string]string{
+		notBeforeKey: "0",
+	}))
+	checkErr(t, err, `metadata key "nbf" is reserved`)
+
+	lock := newTestLock(t, newTestServer(t), WithMetadata(map[string]string{
+		"region": "us-east1",
+	}))
+
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := lock.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(info.Metadata), 1; got != want {
+		t.Errorf("expected %d to be %d: %v", got, want, info.Metadata)
+	}
+	if got, want := info.Metadata["region"], "us-east1"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if !info.HeldAt(time.Now()) {
+		t.Errorf("expected lock to be held")
+	}
+}
+
+func TestGCSLock_Info_acquiredAt(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+
+	// By default, no acquisition time is recorded.
+	lock := newTestLock(t, gcsServer)
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	info, err := lock.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.AcquiredAt.IsZero() {
+		t.Errorf("expected %s to be zero", info.AcquiredAt)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	lock = newTestLock(t, gcsServer, WithTrackAcquiredAt())
+	acquiredAt := time.Unix(time.Now().Unix(), 0).UTC()
+	now := acquiredAt
+	lock.nowFunc = func() time.Time { return now }
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	// Renewals keep the original acquisition time.
+	now = now.Add(time.Minute)
+	if err := lock.Renew(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err = lock.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.AcquiredAt, acquiredAt; !got.Equal(want) {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+	if _, ok := info.Metadata[acquiredAtKey]; ok {
+		t.Errorf("expected %q to be omitted from metadata", acquiredAtKey)
+	}
+
+	// A new acquisition records a new time.
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	info, err = lock.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.AcquiredAt, now; !got.Equal(want) {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+}
+
+func TestGCSLock_Metadata(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer, WithOwner("node-a"), WithMetadata(map[string]string{
+		"region": "us-east1",
+	}))
+
+	if _, err := lock.Metadata(ctx); !errors.Is(err, ErrLockGone) {
+		t.Errorf("expected %v to be %v", err, ErrLockGone)
+	}
+
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := lock.Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{notBeforeKey, ownerKey, tokenKey, "region"} {
+		if _, ok := metadata[k]; !ok {
+			t.Errorf("expected %q in %v", k, metadata)
+		}
+	}
+
+	// An object written by another tool without metadata.
+	w := gcsServer.Client().Bucket("my-bucket").Object("my-object").NewWriter(ctx)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err = lock.Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata == nil || len(metadata) != 0 {
+		t.Errorf("expected %v to be empty", metadata)
+	}
+}
+
+func TestGCSLock_Ping(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	lock := newTestLock(t, newTestServer(t))
+	if err := lock.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	gcsServer := fakestorage.NewServer(nil)
+	t.Cleanup(gcsServer.Stop)
+	lock = newTestLock(t, gcsServer)
+
+	var bucketErr *BucketNotFoundError
+	if err := lock.Ping(ctx); !errors.As(err, &bucketErr) {
+		t.Fatalf("expected %s (%T) to be %T", err, err, bucketErr)
+	}
+}
+
+func TestGCSLock_Info_stateCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer, WithStateCache(time.Hour))
+
+	// Prime the cache with the missing object.
+	held, err := lock.Held(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held {
+		t.Fatal("expected lock to not be held")
+	}
+
+	// Writes by other processes are not observed while cached.
+	writeTestLock(t, gcsServer, time.Now().Add(ttl))
+	held, err = lock.Held(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held {
+		t.Errorf("expected cached result")
+	}
+
+	// Our own writes invalidate the cache.
+	writeTestLock(t, gcsServer, time.Now().Add(-ttl))
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := lock.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Generation, objectGeneration(t, gcsServer); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestListLocks(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	for _, object := range []string{"locks/b", "locks/a"} {
+		if err := lock.withObject(object).Acquire(ctx, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestLock(t, gcsServer, time.Now().Add(ttl))
+
+	infos, err := ListLocks(ctx, gcsServer.Client(), "my-bucket", "locks/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Object)
+		if !info.HeldAt(time.Now()) {
+			t.Errorf("expected %q to be held", info.Object)
+		}
+	}
+	if got, want := strings.Join(names, ","), "locks/a,locks/b"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// A corrupt lock is skipped, and the others are still returned.
+	w := gcsServer.Client().Bucket("my-bucket").Object("locks/c").NewWriter(ctx)
+	w.Metadata = map[string]string{notBeforeKey: "banana"}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err = ListLocks(ctx, gcsServer.Client(), "my-bucket", "locks/")
+	checkErr(t, err, `failed to parse lock "locks/c"`)
+	if got, want := len(infos), 2; got != want {
+		t.Errorf("expected %d locks to be %d", got, want)
+	}
+
+	_, err = ListLocks(ctx, gcsServer.Client(), "not-a-bucket", "")
+	var bucketErr *BucketNotFoundError
+	if !errors.As(err, &bucketErr) {
+		t.Errorf("expected %v to be a BucketNotFoundError", err)
+	}
+}
+
+func TestDeleteLock(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	if err := lock.Acquire(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteLock(ctx, gcsServer.Client(), "my-bucket", "my-object"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gcsServer.Client().Bucket("my-bucket").Object("my-object").Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("expected %v to be %v", err, storage.ErrObjectNotExist)
+	}
+
+	// Deleting again is not an error.
+	if err := DeleteLock(ctx, gcsServer.Client(), "my-bucket", "my-object"); err != nil {
+		t.Error(err)
+	}
+
+	// The previous holder no longer owns the lock.
+	if err := lock.Renew(ctx, time.Minute); !errors.Is(err, new(NotLockOwnerError)) {
+		t.Errorf("expected %v to be %T", err, new(NotLockOwnerError))
+	}
+
+	checkErr(t, DeleteLock(ctx, gcsServer.Client(), "my-bucket", ""), "object name cannot be empty")
+}
+
+func TestGCSLock_HeldByMe(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	checkHeldByMe := func(tb testing.TB, want bool) {
+		tb.Helper()
+
+		got, err := lock.HeldByMe(ctx)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if got != want {
+			tb.Errorf("expected %t to be %t", got, want)
+		}
+	}
+
+	checkHeldByMe(t, false)
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	checkHeldByMe(t, true)
+
+	// Our lease expires.
+	lock.nowFunc = func() time.Time { return time.Now().Add(2 * ttl) }
+	checkHeldByMe(t, false)
+	lock.nowFunc = time.Now
+
+	// Another process takes the lock.
+	writeTestLock(t, gcsServer, time.Now().Add(ttl))
+	checkHeldByMe(t, false)
+}
+
+func TestParseNotBefore(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		exp      int64
+		err      string
+	}{
+		{
+			name: "missing",
+			exp:  0,
+		},
+		{
+			name:     "unix",
+			metadata: map[string]string{notBeforeKey: "1902902494"},
+			exp:      1902902494,
+		},
+		{
+			name:     "rfc3339",
+			metadata: map[string]string{notBeforeKey: "2030-04-20T08:01:34Z"},
+			exp:      1902902494,
+		},
+		{
+			name:     "invalid",
+			metadata: map[string]string{notBeforeKey: "tomorrow"},
+			err:      "failed to parse nbf",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseNotBefore(&storage.ObjectAttrs{Metadata: tc.metadata})
+			checkErr(t, err, tc.err)
+			if got != tc.exp {
+				t.Errorf("expected %d to be %d", got, tc.exp)
+			}
+		})
+	}
+}
+
+func TestGCSLock_rfc3339Timestamps(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer, WithRFC3339Timestamps())
+
+	nbf, err := lock.AcquireLease(ctx, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, err := gcsServer.Client().Bucket("my-bucket").Object("my-object").Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := attrs.Metadata[notBeforeKey], nbf.Format(time.RFC3339); got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// Writers using the default format see the lock as held.
+	other := newTestLock(t, gcsServer)
+	if err := other.Acquire(ctx, ttl); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("expected %v to be %v", err, ErrLockHeld)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"time"
+)
+
+// Lease describes a lock acquired by this process.
+type Lease struct {
+	// NotBefore is the time at which the lease expires.
+	NotBefore time.Time
+
+	// Generation and Metageneration are the generation and metageneration of
+	// the lock object that was written when the lease was acquired.
+	Generation     int64
+	Metageneration int64
+
+	// attempts is the number of attempts made to acquire the lease.
+	attempts int
+}
+
+// Remaining returns how long until the lease expires at the given time, or
+// zero if it has already expired.
+func (l *Lease) Remaining(t time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	if d := l.NotBefore.Sub(t); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// leaseContextKey is the context key for the lease.
+type leaseContextKey struct{}
+
+// AcquireContext is like [Lock.Acquire], but on success it returns a context
+// derived from ctx that carries the acquired [Lease]. Downstream code, such as
+// HTTP or gRPC middleware, can retrieve it with [LeaseFromContext] to check
+// the remaining lease time without reading the lock object. On failure, it
+// returns ctx unchanged along with the error.
+func (l *Lock) AcquireContext(ctx context.Context, ttl time.Duration) (context.Context, error) {
+	ctx = l.resolveContext(ctx)
+
+	lease, err := l.acquire(ctx, ttl)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, leaseContextKey{}, lease), nil
+}
+
+// LeaseFromContext returns the lease stored in the context by
+// [Lock.AcquireContext], or nil if there is none.
+func LeaseFromContext(ctx context.Context) *Lease {
+	lease, _ := ctx.Value(leaseContextKey{}).(*Lease)
+	return lease
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGCSLock_AcquireContext(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	if got := LeaseFromContext(ctx); got != nil {
+		t.Errorf("expected no lease, got %#v", got)
+	}
+
+	leaseCtx, err := lock.AcquireContext(ctx, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lease := LeaseFromContext(leaseCtx)
+	if lease == nil {
+		t.Fatal("expected lease in context")
+	}
+	if got, want := lease.Generation, objectGeneration(t, gcsServer); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if remaining := lease.Remaining(time.Now()); remaining <= 0 || remaining > ttl {
+		t.Errorf("expected %s to be in (0, %s]", remaining, ttl)
+	}
+
+	// A failed acquire returns the original context.
+	failedCtx, err := lock.AcquireContext(ctx, ttl)
+	var lockErr *LockHeldError
+	if !errors.As(err, &lockErr) {
+		t.Fatalf("expected %s (%T) to be %T", err, err, lockErr)
+	}
+	if failedCtx != ctx {
+		t.Errorf("expected original context to be returned")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LockSet is a family of independent locks, one per shard, that share a single
+// storage client and retry policy. This is useful for sharded leader election,
+// where creating a separate [Lock] (and client) for each shard is expensive.
+//
+// Each shard builds its own instance of the retry policy, so retries for one
+// shard do not consume the retry budget of another.
+//
+// The lock for a shard is stored in the object named "object/shardKey", where
+// object is the name given to [NewLockSet].
+type LockSet struct {
+	base *Lock
+
+	mu    sync.Mutex
+	locks map[string]*Lock
+}
+
+// NewLockSet creates a new set of locks under the given object prefix. The
+// options are applied to every lock in the set.
+func NewLockSet(ctx context.Context, bucket, object string, opts ...Option) (*LockSet, error) {
+	base, err := NewWithOptions(ctx, bucket, object, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LockSet{
+		base:  base,
+		locks: make(map[string]*Lock),
+	}, nil
+}
+
+// Lock returns the lock for the given shard. It always returns the same
+// instance for the same shard, so the lease state is preserved across calls.
+// Closing the returned lock does not close the shared client; use
+// [LockSet.Close] instead.
+func (s *LockSet) Lock(shardKey string) (*Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l, ok := s.locks[shardKey]; ok {
+		return l, nil
+	}
+
+	if shardKey == "" {
+		return nil, fmt.Errorf("shard key cannot be empty")
+	}
+
+	object := s.base.object + "/" + shardKey
+	if err := validateObjectName(object); err != nil {
+		return nil, fmt.Errorf("invalid shard key %q: %w", shardKey, err)
+	}
+
+	l := s.base.withObject(object)
+	s.locks[shardKey] = l
+	return l, nil
+}
+
+// Acquire attempts to acquire the lock for the given shard. See [Lock.Acquire]
+// for details.
+func (s *LockSet) Acquire(ctx context.Context, shardKey string, ttl time.Duration) error {
+	l, err := s.Lock(shardKey)
+	if err != nil {
+		return s.base.acquireError(err)
+	}
+	return l.Acquire(ctx, ttl)
+}
+
+// Close terminates the shared client connection. It does not delete any locks.
+func (s *LockSet) Close(ctx context.Context) error {
+	return s.base.Close(ctx)
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockSet_Acquire(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+
+	set, err := NewLockSet(ctx, "my-bucket", "my-object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := set.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+	set.base.client = gcsServer.Client()
+
+	if err := set.Acquire(ctx, "a", ttl); err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Acquire(ctx, "b", ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	var lockErr *LockHeldError
+	if err := set.Acquire(ctx, "a", ttl); !errors.As(err, &lockErr) {
+		t.Fatalf("expected %s (%T) to be %T", err, err, lockErr)
+	}
+
+	if _, err := gcsServer.Client().Bucket("my-bucket").Object("my-object/b").Attrs(ctx); err != nil {
+		t.Errorf("expected shard object to exist: %s", err)
+	}
+
+	a, err := set.Lock("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := a.client, set.base.client; got != want {
+		t.Errorf("expected shard to share the client")
+	}
+
+	// Closing a shard does not close the shared client.
+	if err := a.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Acquire(ctx, "c", ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := set.Lock(""); err == nil {
+		t.Errorf("expected error, got nothing")
+	}
+}
+
+func TestLockSet_retryPolicy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	set, err := NewLockSet(ctx, "my-bucket", "my-object",
+		WithRetryJitterPercent(0),
+		WithExponentialBackoff(time.Millisecond, time.Millisecond, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := set.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	a, err := set.Lock("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := set.Lock("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exhausting the retries of one shard leaves the others unaffected.
+	retryAttempts(ctx, t, a)
+	if got, want := retryAttempts(ctx, t, b), 3; got != want {
+		t.Errorf("expected %d attempts to be %d", got, want)
+	}
+}
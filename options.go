@@ -0,0 +1,778 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/sethvargo/go-retry"
+	"google.golang.org/api/option"
+)
+
+// Option is a configuration option for [NewWithOptions].
+type Option func(l *Lock) error
+
+// WithClientOptions passes the given options to the underlying storage client.
+// The gcslock user agent is always set first, so these options can override it.
+func WithClientOptions(opts ...option.ClientOption) Option {
+	return func(l *Lock) error {
+		l.clientOpts = append(l.clientOpts, opts...)
+		return nil
+	}
+}
+
+// WithClampToContextDeadline shortens the ttl passed to [Lock.Acquire] so that
+// the lock never expires after the deadline on the provided context. This
+// keeps leases from outliving the process that owns them: if the caller is
+// killed when its context expires, other processes can acquire the lock
+// immediately instead of waiting for the full ttl. If the context deadline has
+// already passed, or leaves less than the minimum ttl of 1s, Acquire returns an
+// error without writing anything.
+func WithClampToContextDeadline() Option {
+	return func(l *Lock) error {
+		l.clampToContextDeadline = true
+		return nil
+	}
+}
+
+// WithChunkSize sets the chunk size used when writing the lock object. The
+// default is 1024 bytes. Google Cloud Storage requires chunks to be a multiple
+// of 256KiB, so any non-zero value is rounded up to the nearest multiple by the
+// storage client. A value of zero disables chunking and uploads the object in a
+// single request. Negative values are rejected.
+func WithChunkSize(size int) Option {
+	return func(l *Lock) error {
+		if size < 0 {
+			return fmt.Errorf("chunk size %d must be non-negative", size)
+		}
+		l.chunkSize = size
+		return nil
+	}
+}
+
+// WithCacheControl sets the Cache-Control header on the lock object. The
+// default disables all caching, since stale reads of the lock state could
+// cause two processes to believe they hold the lock. Only change this if an
+// intermediary in front of the bucket misbehaves with the default.
+func WithCacheControl(cacheControl string) Option {
+	return func(l *Lock) error {
+		l.cacheControl = cacheControl
+		return nil
+	}
+}
+
+// WithKMSKey sets the Cloud KMS key used to encrypt the lock object, for
+// buckets that require customer-managed encryption keys. The key is used for
+// every write, including renewals. The value must be the full resource name of
+// the key:
+//
+//	projects/P/locations/L/keyRings/R/cryptoKeys/K
+func WithKMSKey(name string) Option {
+	return func(l *Lock) error {
+		l.kmsKeyName = name
+		return nil
+	}
+}
+
+// WithStorageClass sets the storage class of the lock object, overriding the
+// default storage class of the bucket. The lock object is tiny and written
+// often, so in a bucket that defaults to a colder class, STANDARD avoids
+// minimum storage durations and early deletion charges on every renewal. The
+// class is case-insensitive and must be one of STANDARD, NEARLINE, COLDLINE,
+// ARCHIVE, or a legacy class such as REGIONAL. By default, the bucket default
+// is used.
+func WithStorageClass(class string) Option {
+	return func(l *Lock) error {
+		class = strings.ToUpper(class)
+		switch class {
+		case "STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE",
+			"MULTI_REGIONAL", "REGIONAL", "DURABLE_REDUCED_AVAILABILITY":
+		default:
+			return fmt.Errorf("storage class %q is not a known storage class", class)
+		}
+		l.storageClass = class
+		return nil
+	}
+}
+
+// WithPredefinedACL applies the given predefined ACL, such as "projectPrivate"
+// or "private", to the lock object on every write, instead of the default
+// object ACL of the bucket. This protects lock objects in shared buckets whose
+// default object ACL is more permissive than intended. ACLs that grant read
+// access outside the project, "publicRead" and "authenticatedRead", are
+// rejected.
+//
+// Buckets with uniform bucket-level access ignore object ACLs and reject writes
+// that set one, so this option must not be used with them; access is then
+// controlled by IAM on the bucket alone. Acquiring such a lock returns a
+// [*ConfigurationError]. Because uniform bucket-level access is the
+// recommended configuration, no ACL is set by default.
+func WithPredefinedACL(acl string) Option {
+	return func(l *Lock) error {
+		switch acl {
+		case "private", "projectPrivate", "bucketOwnerRead", "bucketOwnerFullControl":
+		case "publicRead", "authenticatedRead":
+			return fmt.Errorf("predefined acl %q would expose the lock object outside the project", acl)
+		default:
+			return fmt.Errorf("predefined acl %q is not a known predefined acl", acl)
+		}
+		l.predefinedACL = acl
+		return nil
+	}
+}
+
+// WithContentionPolicy sets the backoff used by [Lock.AcquireWait] between
+// attempts while the lock is held by another process. This is independent of
+// the retry policy for failed API calls, which typically wants short waits,
+// whereas contention waits are usually tied to the lock ttl. When the policy
+// stops, AcquireWait returns the last [*LockHeldError].
+//
+// Backoffs are stateful, so fn is called to build a new one for each call to
+// AcquireWait, and must not return a shared instance:
+//
+//	WithContentionPolicy(func() retry.Backoff {
+//	  return retry.WithMaxRetries(5, retry.NewConstant(time.Second))
+//	})
+//
+// By default, AcquireWait waits until the current lease expires.
+func WithContentionPolicy(fn func() retry.Backoff) Option {
+	return func(l *Lock) error {
+		if fn == nil {
+			return fmt.Errorf("contention policy cannot be nil")
+		}
+		l.contentionPolicy = fn
+		l.contentionBackoff = nil
+		return nil
+	}
+}
+
+// WithContentionBackoff makes [Lock.AcquireWait] poll with an exponential
+// backoff while the lock is held by another process, starting at base and
+// doubling up to maxWait, with the jitter from [WithRetryJitterPercent]. This
+// spreads out reads when the holder keeps renewing its lease. It never sleeps
+// past the expiration of the current lease, so a lock that frees naturally is
+// still acquired promptly, and maxWait bounds how long an early release goes
+// unnoticed. The backoff restarts on each call to AcquireWait, and it replaces
+// any policy set with [WithContentionPolicy].
+func WithContentionBackoff(base, maxWait time.Duration) Option {
+	return func(l *Lock) error {
+		if base <= 0 {
+			return fmt.Errorf("contention backoff base %s must be positive", base)
+		}
+		if maxWait < base {
+			return fmt.Errorf("contention backoff max wait %s must be at least base %s", maxWait, base)
+		}
+
+		l.contentionPolicy = nil
+		l.contentionBackoff = func() retry.Backoff {
+			b := retry.WithCappedDuration(maxWait, retry.NewExponential(base))
+			if l.retryJitterPercent > 0 {
+				b = retry.WithJitterPercent(l.retryJitterPercent, b)
+			}
+			return b
+		}
+		return nil
+	}
+}
+
+// WithRetryJitterPercent sets the jitter, as a percentage, applied to the
+// default retry policy for failed API calls. For example, a value of 25 makes
+// each wait 25% longer or shorter at random. This spreads out retries when
+// many processes contend for the lock at the same time, such as during a
+// rollout. The default is 25. A value of 0 disables jitter, and values greater
+// than 100 are rejected.
+func WithRetryJitterPercent(pct uint64) Option {
+	return func(l *Lock) error {
+		if pct > 100 {
+			return fmt.Errorf("retry jitter percent %d must be between 0 and 100", pct)
+		}
+		l.retryJitterPercent = pct
+		return nil
+	}
+}
+
+// WithForce makes [Lock.ForceAcquire] overwrite the lock object without
+// checking whether it is held. It has no effect on the other methods.
+//
+// WARNING: forcing over a live lock breaks mutual exclusion. This is intended
+// only for operator recovery tooling.
+func WithForce() Option {
+	return func(l *Lock) error {
+		l.force = true
+		return nil
+	}
+}
+
+// WithRequestReason sets the x-goog-request-reason header on every write to
+// the lock object, including acquires, renewals, and releases. The reason is
+// recorded in Cloud Audit Logs, which makes it possible to trace which service
+// performed a lock operation.
+func WithRequestReason(reason string) Option {
+	return func(l *Lock) error {
+		l.requestReason = reason
+		return nil
+	}
+}
+
+// WithDryRun makes [Lock.Acquire] perform all of its reads and checks without
+// writing the lock object. It returns nil if the lock would have been acquired,
+// or a [*LockHeldError] if it is held. Likewise, [Lock.CompareAndAcquire] only
+// checks the generation of the lock object, and [Lock.ForceAcquire] never
+// overwrites it. This is useful for validating configuration and lock state
+// against production buckets without mutating them. Note that a successful dry
+// run only proves read access; write permissions are not checked.
+func WithDryRun() Option {
+	return func(l *Lock) error {
+		l.dryRun = true
+		return nil
+	}
+}
+
+// WithMetadata attaches additional metadata to the lock object on every write,
+// such as a deployment version or region, so that observers can learn more
+// about the holder. The metadata is returned in [LockInfo]. Keys that are
+// reserved by gcslock to store lock state are rejected.
+func WithMetadata(metadata map[string]string) Option {
+	return func(l *Lock) error {
+		if l.metadata == nil {
+			l.metadata = make(map[string]string, len(metadata))
+		}
+
+		for k, v := range metadata {
+			if isReservedMetadataKey(k) {
+				return fmt.Errorf("metadata key %q is reserved", k)
+			}
+			l.metadata[k] = v
+		}
+		return nil
+	}
+}
+
+// WithMaxTTL sets the maximum ttl that can be requested when acquiring or
+// renewing the lock. Requests for a longer ttl return an error without writing
+// to the lock object. This is a safety rail against bugs in duration math
+// that could otherwise block other processes for days. By default, there is no
+// maximum.
+func WithMaxTTL(d time.Duration) Option {
+	return func(l *Lock) error {
+		if d < 0 {
+			return fmt.Errorf("max ttl %s must be non-negative", d)
+		}
+		l.maxTTL = d
+		return nil
+	}
+}
+
+// WithTTLRoundUp rounds the lease expiration up to the next whole second
+// instead of truncating the current time and ttl. Lock timestamps have second
+// granularity, so by default a lease can be up to a second shorter than
+// requested, which matters for tight back-to-back leases.
+//
+// Rounding up makes the lease up to a second longer than requested instead.
+// This errs on the side of safety, since other processes whose clocks run
+// slightly ahead are less likely to see the lock as expired while the holder
+// still believes it is valid, at the cost of slightly delaying failover.
+func WithTTLRoundUp() Option {
+	return func(l *Lock) error {
+		l.ttlRoundUp = true
+		return nil
+	}
+}
+
+// WithStateCache caches the result of [Lock.Info], and the methods built on it
+// such as [Lock.Held], for the given duration. This reduces reads and cost in
+// tight polling loops. The cache is invalidated whenever this process writes
+// the lock object, so it never serves stale data after our own acquire, renew,
+// or release. It can still serve stale data after writes by other processes,
+// for up to the cache duration. By default, there is no cache.
+func WithStateCache(ttl time.Duration) Option {
+	return func(l *Lock) error {
+		if ttl < 0 {
+			return fmt.Errorf("state cache ttl %s must be non-negative", ttl)
+		}
+		l.stateCacheTTL = ttl
+		return nil
+	}
+}
+
+// WithGRPC creates the storage client using the gRPC transport instead of JSON
+// over HTTP, which reduces per-call latency for small metadata operations. If
+// the gRPC client cannot be constructed, it falls back to JSON over HTTP.
+// Options from [WithClientOptions] are passed to either client.
+func WithGRPC() Option {
+	return func(l *Lock) error {
+		l.grpc = true
+		return nil
+	}
+}
+
+// WithOperationTimeout bounds each individual upstream API call, such as
+// reading or writing the lock object, to the given duration. The timeout is
+// applied in addition to any deadline on the caller's context, and each retry
+// attempt gets a fresh timeout. This prevents a single hung call from blocking
+// an operation indefinitely when the caller's context has no deadline. By
+// default, there is no per-operation timeout.
+func WithOperationTimeout(d time.Duration) Option {
+	return func(l *Lock) error {
+		if d < 0 {
+			return fmt.Errorf("operation timeout %s must be non-negative", d)
+		}
+		l.operationTimeout = d
+		return nil
+	}
+}
+
+// WithCreateBucketIfMissing creates the lock bucket in the given project with
+// the given attributes (which may be nil) if acquiring the lock finds that the
+// bucket does not exist, and then retries the acquisition. If another process
+// creates the bucket concurrently, that is treated as success, but a bucket of
+// the same name owned by another project that we cannot access is an error.
+// This is intended for ephemeral test and CI environments. It requires
+// permission to create buckets in the project (storage.buckets.create), which
+// is much broader than the object permissions otherwise needed to manage the
+// lock.
+func WithCreateBucketIfMissing(projectID string, attrs *storage.BucketAttrs) Option {
+	return func(l *Lock) error {
+		if projectID == "" {
+			return fmt.Errorf("project ID is required to create the bucket")
+		}
+		l.createBucketProject = projectID
+		l.createBucketAttrs = attrs
+		return nil
+	}
+}
+
+// WithStorageRetry configures how the storage client retries individual
+// requests to the lock object, for example with [storage.WithBackoff] or
+// [storage.WithPolicy]. This is separate from, and happens beneath, the retry
+// policy gcslock uses for contended or throttled acquisitions. By default, the
+// storage client's own retry behavior is used. Multiple calls are additive.
+func WithStorageRetry(opts ...storage.RetryOption) Option {
+	return func(l *Lock) error {
+		l.storageRetryOpts = append(l.storageRetryOpts, opts...)
+		return nil
+	}
+}
+
+// WithOnRetry registers a callback that is invoked before each retry of a
+// failed acquisition attempt, with the number of the attempt that failed
+// (starting at 1) and the error that caused the retry. It is purely
+// observational and is useful for logging or emitting metrics. The callback is
+// called synchronously, so it should return quickly.
+func WithOnRetry(fn func(attempt int, err error)) Option {
+	return func(l *Lock) error {
+		l.onRetry = fn
+		return nil
+	}
+}
+
+// WithOnAcquire registers a hook that is invoked after each successful
+// acquisition, with the state of the lease just written, for example to record
+// it in an audit log or database. It is called synchronously, before the
+// acquisition returns, with the caller's context.
+//
+// If the hook returns an error, the lease is rolled back by releasing the lock,
+// and the acquisition returns the hook error. If that release also fails, its
+// error is joined to the hook error and the lease remains held until its ttl
+// expires. Rollback only covers the lock: the lock object was written before
+// the hook ran, so other processes may briefly observe the lock as held, and
+// if this process crashes before or during the hook, the lease is held without
+// a record. The hook is not called for renewals, dry runs, or
+// [Lock.ForceAcquire].
+func WithOnAcquire(fn func(ctx context.Context, info LockInfo) error) Option {
+	return func(l *Lock) error {
+		if fn == nil {
+			return fmt.Errorf("on acquire hook cannot be nil")
+		}
+		l.onAcquire = fn
+		return nil
+	}
+}
+
+// WithEndpoint sends requests to the given Google Cloud Storage API endpoint
+// instead of the default, for example a Private Service Connect endpoint or
+// restricted.googleapis.com inside a VPC Service Controls perimeter. The
+// endpoint must be an http or https URL including the API path, such as
+// "https://storage-myendpoint.p.googleapis.com/storage/v1/". It takes precedence
+// over an endpoint provided with [WithClientOptions], and the gcslock user agent
+// is still set.
+func WithEndpoint(endpoint string) Option {
+	return func(l *Lock) error {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid endpoint %q: scheme must be http or https", endpoint)
+		}
+		if u.Host == "" {
+			return fmt.Errorf("invalid endpoint %q: missing host", endpoint)
+		}
+		l.endpoint = endpoint
+		return nil
+	}
+}
+
+// WithHTTPClient uses the given HTTP client for all requests to Google Cloud
+// Storage, for example to route traffic through a proxy or to customize TLS.
+// The gcslock user agent is still added to every request.
+//
+// The storage client uses the HTTP client as-is, so it must handle
+// authentication itself, such as one created with
+// golang.org/x/oauth2/google.DefaultClient. Credentials provided with
+// [WithClientOptions] are ignored. This option is not supported with
+// [WithGRPC], and [NewWithOptions] returns a [*ConfigurationError] if both are
+// given.
+func WithHTTPClient(client *http.Client) Option {
+	return func(l *Lock) error {
+		if client == nil {
+			return fmt.Errorf("http client cannot be nil")
+		}
+		l.httpClient = client
+		return nil
+	}
+}
+
+// WithMaxConnsPerHost limits the number of connections, including idle ones,
+// that the storage client keeps to Google Cloud Storage. Locks for many shards
+// that share a client can exhaust the default pool, which only keeps a few idle
+// connections and so repeatedly dials new ones under load.
+//
+// gcslock builds the HTTP client from the options given to
+// [WithClientOptions], so credentials and the endpoint configured there still
+// apply. This option is not supported with [WithHTTPClient], whose transport
+// should be tuned directly, or with [WithGRPC], and [NewWithOptions] returns a
+// [*ConfigurationError] if either is also given.
+func WithMaxConnsPerHost(n int) Option {
+	return func(l *Lock) error {
+		if n <= 0 {
+			return fmt.Errorf("max conns per host %d must be positive", n)
+		}
+		l.maxConnsPerHost = n
+		return nil
+	}
+}
+
+// WithObjectTemplate computes the name of the lock object from the current
+// time each time the lock is acquired, overriding the object given to
+// [NewWithOptions]. This makes time-bucketed locks, such as one leader per day,
+// trivial:
+//
+//	gcslock.WithObjectTemplate(func(t time.Time) string {
+//	  return "locks/" + t.Format(time.DateOnly) + "/leader"
+//	})
+//
+// Old lock objects are left in place, so they can be removed by an object
+// lifecycle policy. Renewals and releases target the object from the most
+// recent acquisition. The template must return a valid object name.
+func WithObjectTemplate(fn func(time.Time) string) Option {
+	return func(l *Lock) error {
+		if fn == nil {
+			return fmt.Errorf("object template cannot be nil")
+		}
+		l.objectTemplate = fn
+		return nil
+	}
+}
+
+// WithOwner records the given owner, such as a hostname or pod name, on the
+// lock object with every write by this process. Other processes can read it
+// with [Lock.Info] to see who holds the lock. It is also the identity used by
+// [Lock.Transfer]. By default, no owner is recorded.
+func WithOwner(owner string) Option {
+	return func(l *Lock) error {
+		if owner == "" {
+			return fmt.Errorf("owner cannot be empty")
+		}
+		l.owner = owner
+		return nil
+	}
+}
+
+// WithStickyOwner records the given owner like [WithOwner], and additionally
+// reserves an expired lock for its previous owner for the grace period after
+// the lease expires. During that window, only a process with the same owner can
+// re-acquire it; afterwards, anyone can. This lets a leader that briefly failed
+// to renew, such as during a transient outage, keep leadership and its warm
+// caches instead of flapping to another node.
+//
+// The reservation is enforced by the processes trying to acquire, so every
+// process contending for the lock should use this option with the same grace.
+// It delays failover by up to grace when the previous owner does not return.
+func WithStickyOwner(owner string, grace time.Duration) Option {
+	return func(l *Lock) error {
+		if owner == "" {
+			return fmt.Errorf("owner cannot be empty")
+		}
+		if grace <= 0 {
+			return fmt.Errorf("sticky grace %s must be positive", grace)
+		}
+		l.owner = owner
+		l.stickyGrace = grace
+		return nil
+	}
+}
+
+// WithExponentialBackoff replaces the default retry policy for failed API calls
+// and contended writes with an exponential backoff that starts at base, doubles
+// on each retry up to maxDelay, and gives up after maxRetries retries. Jitter from
+// [WithRetryJitterPercent] is still applied. By default, gcslock uses a
+// Fibonacci backoff starting at 50ms with up to 5 retries.
+func WithExponentialBackoff(base, maxDelay time.Duration, maxRetries uint64) Option {
+	return func(l *Lock) error {
+		if base <= 0 {
+			return fmt.Errorf("backoff base %s must be positive", base)
+		}
+		if maxDelay < base {
+			return fmt.Errorf("backoff max delay %s must be at least the base %s", maxDelay, base)
+		}
+		l.exponentialBase = base
+		l.exponentialCap = maxDelay
+		l.maxRetries = maxRetries
+		return nil
+	}
+}
+
+// WithUserAgentSuffix appends the given suffix, such as "myservice/2.3.1", to
+// the gcslock user agent on every request, so that traffic can be attributed
+// to a specific application in Cloud Audit Logs. A user agent provided with
+// [WithClientOptions] still takes precedence. The suffix may only contain
+// visible ASCII characters and spaces.
+func WithUserAgentSuffix(suffix string) Option {
+	return func(l *Lock) error {
+		if err := validateUserAgentSuffix(suffix); err != nil {
+			return err
+		}
+		l.userAgentSuffix = suffix
+		return nil
+	}
+}
+
+// WithDisableCompression stores the lock object verbatim by setting an
+// identity content encoding and an opaque content type, and ensures the
+// Cache-Control header includes "no-transform" so that intermediaries do not
+// compress or otherwise modify it. This prevents CRC32C mismatches in
+// environments with transforming proxies. The CRC32C checksum is still sent.
+func WithDisableCompression() Option {
+	return func(l *Lock) error {
+		l.disableCompression = true
+		return nil
+	}
+}
+
+// WithRFC3339Timestamps writes the expiration of the lock as an RFC3339
+// timestamp instead of Unix seconds, so that it is readable by operators in the
+// Cloud Console. Both formats are always accepted when reading, so processes
+// with and without this option can safely share the same lock.
+func WithRFC3339Timestamps() Option {
+	return func(l *Lock) error {
+		l.rfc3339Timestamps = true
+		return nil
+	}
+}
+
+// WithClockSkew treats a lock held by another process as held until its
+// expiration plus the given duration, rounded up to the second. This protects
+// against two processes holding the lock at once when the holder's clock is
+// behind ours, at the cost of leaving the lock unavailable for longer after a
+// holder stops renewing it. It applies to every way of acquiring the lock,
+// including [Lock.ForceAcquire] and [Lock.AcquireIf]. A [*LockHeldError]
+// reports the expiration including the skew. The default is zero, which trusts
+// the expiration as written.
+func WithClockSkew(d time.Duration) Option {
+	return func(l *Lock) error {
+		if d < 0 {
+			return fmt.Errorf("clock skew %s must be non-negative", d)
+		}
+		l.clockSkew = d
+		return nil
+	}
+}
+
+// WithSkipPreRead makes acquisition first attempt to create the lock object
+// without reading it. If the object does not exist, this takes one round trip
+// instead of two, which roughly halves the latency of acquiring a lock that is
+// usually released with [Lock.Release]. If the object already exists, the
+// create fails and the lock is read and acquired as usual, which costs one
+// extra round trip. Use it when lock objects are usually absent, such as under
+// high contention for locks that are deleted on release. It has no effect with
+// [WithDryRun].
+func WithSkipPreRead() Option {
+	return func(l *Lock) error {
+		l.skipPreRead = true
+		return nil
+	}
+}
+
+// WithFallbackBucket acquires the lock in the given bucket if the primary bucket
+// is unavailable (503) after exhausting retries, for example during a regional
+// outage. Each acquisition tries the primary bucket first. Renewals and releases
+// target the bucket of the most recent acquisition.
+//
+// WARNING: the two buckets are independent, so a process that falls back and a
+// process that can still reach the primary bucket can both hold the lock at the
+// same time. This trades mutual exclusion for availability, and must only be
+// used when a split brain is acceptable. It is disabled by default.
+func WithFallbackBucket(bucket string) Option {
+	return func(l *Lock) error {
+		if err := validateBucketName(bucket); err != nil {
+			return fmt.Errorf("invalid fallback bucket: %w", err)
+		}
+		l.fallbackBucket = bucket
+		return nil
+	}
+}
+
+// WithBodyWriter writes an informational body into the lock object whenever it
+// is written, for example a small JSON document describing the holder and expiry
+// for audit tooling. The function receives the lock info being written; the
+// generation is not yet known. The nbf metadata remains the source of truth, and
+// the body is never read by gcslock. If the function returns an error, the write
+// fails and nothing is written. By default, the lock object has no body.
+func WithBodyWriter(fn func(w io.Writer, info LockInfo) error) Option {
+	return func(l *Lock) error {
+		l.bodyWriter = fn
+		return nil
+	}
+}
+
+// WithStrictMetadata returns a [*CorruptLockError] when acquiring if the lock
+// object exists but does not have a parseable nbf, instead of treating it as an
+// expired lock and overwriting it. This protects objects written by other tools
+// from being clobbered. By default, a missing nbf is treated as expired.
+func WithStrictMetadata() Option {
+	return func(l *Lock) error {
+		l.strictMetadata = true
+		return nil
+	}
+}
+
+// WithVerifyAfterWrite re-reads the lock object after each acquisition and
+// checks that the stored nbf matches what was written. If another process raced
+// us, an intermediary dropped the metadata, or the object cannot be re-read,
+// the write is undone and the acquisition is retried according to the retry
+// policy. Undoing deletes the object only if it is still at the generation we
+// wrote, so it never removes a lease written by another process. This costs an
+// extra read per acquisition, and is intended for diagnosing misconfigured
+// environments. By default, writes are not verified.
+func WithVerifyAfterWrite() Option {
+	return func(l *Lock) error {
+		l.verifyAfterWrite = true
+		return nil
+	}
+}
+
+// WithMinAcquireInterval makes acquiring return [ErrTooSoon], without calling
+// Google Cloud Storage, if this lock was successfully acquired less than d ago.
+// It is a client-side guard against runaway loops that would otherwise
+// generate excessive writes, not a substitute for renewing with [Lock.Renew].
+// Failed attempts, such as when the lock is held by another process, do not
+// count, so polling with [Lock.AcquireWait] is unaffected. By default, there is
+// no minimum interval.
+func WithMinAcquireInterval(d time.Duration) Option {
+	return func(l *Lock) error {
+		if d <= 0 {
+			return fmt.Errorf("min acquire interval %s must be positive", d)
+		}
+		l.minAcquireInterval = d
+		return nil
+	}
+}
+
+// WithTrackAcquiredAt records the time at which each lease was acquired on the
+// lock object, in addition to its expiration. Renewals keep the original time,
+// so other processes can read it with [Lock.Info] as [LockInfo.AcquiredAt] to
+// see how long the current holder has held the lock, and to detect holders
+// that renew forever. By default, no acquisition time is recorded.
+func WithTrackAcquiredAt() Option {
+	return func(l *Lock) error {
+		l.trackAcquiredAt = true
+		return nil
+	}
+}
+
+// WithUnwrappedErrors makes [Lock.Acquire] and its variants return the
+// underlying error directly, such as a [*LockHeldError], instead of wrapping it
+// with "failed to acquire lock". This keeps log messages terse and lets callers
+// use type assertions on the returned value. By default, errors are wrapped.
+func WithUnwrappedErrors() Option {
+	return func(l *Lock) error {
+		l.unwrappedErrors = true
+		return nil
+	}
+}
+
+// WithAutoDeleteAfter sets the Custom-Time of the lock object to d after the
+// lease expires, so that a bucket lifecycle rule can delete lock objects that
+// are no longer used. Every write sets it again, so a lock that is renewed or
+// re-acquired is never deleted while it is held. Configure the bucket with:
+//
+//	{
+//	  "lifecycle": {
+//	    "rule": [{
+//	      "action": {"type": "Delete"},
+//	      "condition": {"daysSinceCustomTime": 0}
+//	    }]
+//	  }
+//	}
+//
+// Lifecycle rules run asynchronously, usually within a day of the object
+// becoming eligible. Deleting an expired lock object is always safe. By
+// default, Custom-Time is not set.
+func WithAutoDeleteAfter(d time.Duration) Option {
+	return func(l *Lock) error {
+		if d < 0 {
+			return fmt.Errorf("auto delete duration %s must be non-negative", d)
+		}
+		l.autoDelete = true
+		l.autoDeleteAfter = d
+		return nil
+	}
+}
+
+// WithIdempotencyKey sends an idempotency token with every write of the lock
+// object, so that Google Cloud Storage can recognize a write that gcslock
+// re-issues after an ambiguous network failure as a duplicate instead of
+// creating another generation. The token is the key followed by a random nonce
+// that is chosen once for each acquisition and reused when gcslock retries its
+// write, until the write definitively fails its precondition and the next
+// attempt becomes a different write. Every renewal uses a new nonce. The nonce
+// is also the ownership token stored in the object, so a deduplicated write is
+// indistinguishable from the original. The key should be unique to the
+// process, such as a hostname or random ID.
+//
+// The generation preconditions on each write are unchanged and remain the only
+// guarantee of mutual exclusion; the idempotency token only reduces generation
+// churn. If a re-issued write is not deduplicated, an acquisition that finds
+// its own ownership token on the object adopts that lease instead of treating
+// the lock as held. The token replaces the one the storage client generates
+// for each call. This option is not supported with [WithGRPC], and
+// [NewWithOptions] returns a [*ConfigurationError] if both are given.
+func WithIdempotencyKey(key string) Option {
+	return func(l *Lock) error {
+		if key == "" {
+			return fmt.Errorf("idempotency key cannot be empty")
+		}
+		l.idempotencyKey = key
+		return nil
+	}
+}
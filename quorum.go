@@ -0,0 +1,104 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AcquireQuorum attempts to acquire every lock in parallel with the given ttl,
+// and succeeds if a majority (floor(N/2)+1) of them are acquired. This gives
+// stronger safety when the locks live in independent buckets or regions, since
+// two callers cannot both hold a majority.
+//
+// On success, exactly a majority of the locks are held, in the order given; any
+// surplus locks are released.
+//
+// On failure, every lock acquired by this call is released, and the error
+// reports which objects were held by others and wraps the error from each lock
+// that failed.
+func AcquireQuorum(ctx context.Context, locks []*Lock, ttl time.Duration) error {
+	if len(locks) == 0 {
+		return fmt.Errorf("failed to acquire quorum: no locks given")
+	}
+
+	errs := make([]error, len(locks))
+	var wg sync.WaitGroup
+	for i, l := range locks {
+		wg.Add(1)
+		go func(i int, l *Lock) {
+			defer wg.Done()
+			errs[i] = l.Acquire(ctx, ttl)
+		}(i, l)
+	}
+	wg.Wait()
+
+	quorum := len(locks)/2 + 1
+
+	// The context may be cancelled, so detach from it when releasing.
+	releaseCtx := context.WithoutCancel(ctx)
+
+	var acquired int
+	for _, err := range errs {
+		if err == nil {
+			acquired++
+		}
+	}
+
+	if acquired >= quorum {
+		// Surplus locks would expire with the ttl anyway, so failing to release
+		// them is not an error.
+		var kept int
+		for i, l := range locks {
+			if errs[i] != nil {
+				continue
+			}
+			if kept < quorum {
+				kept++
+				continue
+			}
+			_ = l.Release(releaseCtx)
+		}
+		return nil
+	}
+
+	var held []string
+	var failures []error
+	for i, l := range locks {
+		name := fmt.Sprintf("gs://%s/%s", l.bucketName(), l.objectName())
+		if err := errs[i]; err != nil {
+			if errors.Is(err, ErrLockHeld) {
+				held = append(held, name)
+			}
+			failures = append(failures, fmt.Errorf("failed to acquire %s: %w", name, err))
+			continue
+		}
+
+		if err := l.Release(releaseCtx); err != nil {
+			failures = append(failures, fmt.Errorf("failed to release %s: %w", name, err))
+		}
+	}
+
+	msg := fmt.Sprintf("failed to acquire quorum: acquired %d of %d locks, need %d", acquired, len(locks), quorum)
+	if len(held) > 0 {
+		msg += "; held by others: " + strings.Join(held, ", ")
+	}
+	return errors.Join(append([]error{errors.New(msg)}, failures...)...)
+}
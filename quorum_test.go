@@ -0,0 +1,98 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestAcquireQuorum(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	base := newTestLock(t, gcsServer)
+
+	exists := func(tb testing.TB, object string) bool {
+		tb.Helper()
+
+		_, err := gcsServer.Client().Bucket("my-bucket").Object(object).Attrs(ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			tb.Fatal(err)
+		}
+		return err == nil
+	}
+
+	// Another caller holds "a", but "b" and "c" are a majority.
+	if err := base.withObject("a").Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := base.withObject("a"), base.withObject("b"), base.withObject("c")
+	if err := AcquireQuorum(ctx, []*Lock{a, b, c}, ttl); err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range []string{"b", "c"} {
+		if !exists(t, object) {
+			t.Errorf("expected %q to be acquired", object)
+		}
+	}
+
+	// Now "b" and "c" are held, so only "d" can be acquired, which is not a
+	// majority of four.
+	d := base.withObject("d")
+	err := AcquireQuorum(ctx, []*Lock{base.withObject("a"), base.withObject("b"), base.withObject("c"), d}, ttl)
+	checkErr(t, err, "acquired 1 of 4 locks, need 3")
+	checkErr(t, err, "held by others: gs://my-bucket/a, gs://my-bucket/b, gs://my-bucket/c")
+
+	var lockErr *LockHeldError
+	if !errors.As(err, &lockErr) {
+		t.Errorf("expected %v to be a LockHeldError", err)
+	}
+	if exists(t, "d") {
+		t.Errorf("expected %q to be released", "d")
+	}
+}
+
+func TestAcquireQuorum_surplus(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	base := newTestLock(t, gcsServer)
+
+	a, b, c := base.withObject("a"), base.withObject("b"), base.withObject("c")
+	if err := AcquireQuorum(ctx, []*Lock{a, b, c}, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only a majority is kept.
+	if _, err := gcsServer.Client().Bucket("my-bucket").Object("c").Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("expected %q to be released, got %v", "c", err)
+	}
+}
+
+func TestAcquireQuorum_empty(t *testing.T) {
+	t.Parallel()
+
+	checkErr(t, AcquireQuorum(context.Background(), nil, time.Minute), "no locks given")
+}
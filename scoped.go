@@ -0,0 +1,67 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"time"
+)
+
+// scopedReleaseTimeout bounds the best-effort release performed by
+// [Lock.AcquireScoped] after its context is done.
+const scopedReleaseTimeout = 30 * time.Second
+
+// AcquireScoped acquires the lock and ties the lease to the lifetime of ctx.
+// When ctx is cancelled or its deadline passes, the lock is released in the
+// background so that an abandoned job does not block other processes until the
+// ttl expires. The lock is not renewed, so the ttl should cover the expected
+// duration of the work.
+//
+// The release is best-effort. A process that crashes or is killed cannot
+// release the lock, which is why the ttl remains as a backstop. Renewing the
+// lease does not prevent the release, but if this process releases the lock and
+// acquires it again before ctx is done, the background release is skipped so
+// that the new lease is left alone.
+//
+// The background release is given up to 30 seconds to complete. Callers must
+// eventually cancel ctx, or the background goroutine will not exit.
+func (l *Lock) AcquireScoped(ctx context.Context, ttl time.Duration) error {
+	ctx = l.resolveContext(ctx)
+
+	if _, err := l.acquire(ctx, ttl); err != nil {
+		return err
+	}
+
+	// Renewals change the generation but keep the token, so the token
+	// identifies the lease across renewals. The release itself uses the last
+	// recorded generation.
+	token := l.lastToken()
+
+	go func() {
+		<-ctx.Done()
+
+		// Do not release a lease written by a later acquisition.
+		if generation, _ := l.LastGeneration(); generation == 0 || l.lastToken() != token {
+			return
+		}
+
+		releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), scopedReleaseTimeout)
+		defer cancel()
+
+		_ = l.Release(releaseCtx)
+	}()
+
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestGCSLock_AcquireScoped(t *testing.T) {
+	t.Parallel()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := lock.AcquireScoped(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	held, err := lock.Held(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !held {
+		t.Fatal("expected lock to be held")
+	}
+
+	cancel()
+
+	objHandle := gcsServer.Client().Bucket("my-bucket").Object("my-object")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := objHandle.Attrs(context.Background())
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected lock to be released, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGCSLock_AcquireScoped_renewed(t *testing.T) {
+	t.Parallel()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := lock.AcquireScoped(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Renewing changes the generation, but the lease is still released.
+	if err := lock.Renew(context.Background(), 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	objHandle := gcsServer.Client().Bucket("my-bucket").Object("my-object")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := objHandle.Attrs(context.Background())
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected lock to be released, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
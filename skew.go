@@ -0,0 +1,135 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultEndpoint is the Google Cloud Storage endpoint used to estimate
+	// clock skew when no endpoint is configured with [WithEndpoint].
+	defaultEndpoint = "https://storage.googleapis.com/storage/v1/"
+
+	// clockSkewSamples is the number of requests used to estimate clock skew.
+	clockSkewSamples = 3
+)
+
+// EstimateClockSkew estimates the difference between the Google Cloud Storage
+// server clock and the local clock, by comparing the Date header of a few
+// requests against the local time halfway through each request. A positive
+// value means the server clock is ahead. The Date header only has second
+// precision, so the estimate is accurate to about half a second, plus any
+// asymmetry in network latency. Callers can use it to pad their TTLs or to
+// configure [WithClockSkew].
+//
+// Requests are sent to the endpoint configured with [WithEndpoint], or to the
+// default endpoint, using the same HTTP client configuration as the storage
+// client: the client from [WithHTTPClient] if any, and otherwise one built from
+// the options given to [WithClientOptions], so proxies, credentials, and
+// connection limits configured there also apply. A built client is reused by
+// later calls, including those on locks that share the storage client.
+func (l *Lock) EstimateClockSkew(ctx context.Context) (time.Duration, error) {
+	ctx = l.resolveContext(ctx)
+
+	endpoint := defaultEndpoint
+	if l.endpoint != "" {
+		endpoint = l.endpoint
+	}
+
+	client, err := l.skewHTTPClient(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to estimate clock skew: %w", err)
+	}
+
+	var total time.Duration
+	for i := 0; i < clockSkewSamples; i++ {
+		skew, err := l.sampleClockSkew(ctx, client, endpoint)
+		if err != nil {
+			return 0, fmt.Errorf("failed to estimate clock skew: %w", err)
+		}
+		total += skew
+	}
+	return total / clockSkewSamples, nil
+}
+
+// skewClient is the HTTP client used to estimate clock skew. It is built on
+// first use and then reused, so that repeated estimates do not each open new
+// connections.
+type skewClient struct {
+	mu     sync.Mutex
+	client *http.Client
+}
+
+// skewHTTPClient returns the HTTP client for estimating clock skew: the client
+// from [WithHTTPClient] if any, and otherwise one built from the client options
+// the first time it is needed.
+func (l *Lock) skewHTTPClient(ctx context.Context) (*http.Client, error) {
+	clientOpts, ua := l.clientOptions()
+	if l.httpClient != nil {
+		return withUserAgent(l.httpClient, ua), nil
+	}
+
+	l.skewClient.mu.Lock()
+	defer l.skewClient.mu.Unlock()
+
+	if l.skewClient.client != nil {
+		return l.skewClient.client, nil
+	}
+
+	// The credentials may use the context to refresh tokens for as long as the
+	// client is reused, so it must outlive this call.
+	client, err := l.newHTTPClient(context.WithoutCancel(ctx), clientOpts)
+	if err != nil {
+		return nil, err
+	}
+	l.skewClient.client = client
+	return client, nil
+}
+
+// sampleClockSkew makes a single request to the endpoint and returns the
+// difference between the server time and the local time.
+func (l *Lock) sampleClockSkew(ctx context.Context, client *http.Client, endpoint string) (time.Duration, error) {
+	opCtx, cancel := l.operationContext(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(opCtx, http.MethodHead, endpoint, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to build request: %w", err)
+	}
+
+	start := l.now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to make request: %w", err)
+	}
+	_ = resp.Body.Close()
+	end := l.now()
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse Date header %q: %w", resp.Header.Get("Date"), err)
+	}
+
+	// The Date header is truncated to the second, so the server time is, on
+	// average, half a second later.
+	server := date.Add(500 * time.Millisecond)
+	local := start.Add(end.Sub(start) / 2)
+	return server.Sub(local), nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+func TestGCSLock_EstimateClockSkew(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cases := []struct {
+		name string
+		date string
+		exp  time.Duration
+		err  string
+	}{
+		{
+			name: "ahead",
+			date: "Sat, 20 Apr 2030 08:01:44 GMT",
+			exp:  10*time.Second + 500*time.Millisecond,
+		},
+		{
+			name: "behind",
+			date: "Sat, 20 Apr 2030 08:01:24 GMT",
+			exp:  -10*time.Second + 500*time.Millisecond,
+		},
+		{
+			name: "missing",
+			date: "",
+			err:  "failed to parse Date header",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// The request is made with the storage client configuration.
+				if got, want := r.Header.Get("User-Agent"), userAgent; !strings.Contains(got, want) {
+					t.Errorf("expected %q to contain %q", got, want)
+				}
+
+				w.Header()["Date"] = []string{tc.date}
+				w.WriteHeader(http.StatusUnauthorized)
+			}))
+			t.Cleanup(srv.Close)
+
+			lock := newTestLock(t, newTestServer(t),
+				WithClientOptions(option.WithoutAuthentication()),
+				WithEndpoint(srv.URL+"/storage/v1/"))
+			lock.nowFunc = func() time.Time { return time.Unix(1902902494, 0) }
+
+			skew, err := lock.EstimateClockSkew(ctx)
+			checkErr(t, err, tc.err)
+			if got, want := skew, tc.exp; got != want {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+		})
+	}
+}
+
+func TestGCSLock_EstimateClockSkew_reuseClient(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	var conns atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	lock := newTestLock(t, newTestServer(t),
+		WithClientOptions(option.WithoutAuthentication()),
+		WithEndpoint(srv.URL+"/storage/v1/"))
+
+	// Locks that share the storage client also share its connections.
+	for _, l := range []*Lock{lock, lock, lock.ForObject("other")} {
+		if _, err := l.EstimateClockSkew(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := conns.Load(), int64(1); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the operations performed by a [Lock] since it was
+// created. The counts only include operations by this Lock, not by other
+// processes.
+type Stats struct {
+	// Acquires is the number of times the lock was successfully acquired,
+	// including forced and conditional acquisitions. Dry runs are not counted.
+	Acquires int64
+
+	// HeldRejections is the number of acquisitions that failed because the lock
+	// was held.
+	HeldRejections int64
+
+	// Retries is the number of times a failed attempt was retried according to
+	// the retry policy.
+	Retries int64
+
+	// Renewals is the number of times the lease was successfully renewed.
+	Renewals int64
+
+	// Releases is the number of times the lock was successfully released.
+	Releases int64
+}
+
+// lockStats holds the counters behind [Stats]. They are updated atomically so
+// that they can be read while other operations are in flight.
+type lockStats struct {
+	acquires       atomic.Int64
+	heldRejections atomic.Int64
+	retries        atomic.Int64
+	renewals       atomic.Int64
+	releases       atomic.Int64
+}
+
+// Stats returns a snapshot of the operations performed by this lock.
+func (l *Lock) Stats() Stats {
+	return Stats{
+		Acquires:       l.state.stats.acquires.Load(),
+		HeldRejections: l.state.stats.heldRejections.Load(),
+		Retries:        l.state.stats.retries.Load(),
+		Renewals:       l.state.stats.renewals.Load(),
+		Releases:       l.state.stats.releases.Load(),
+	}
+}
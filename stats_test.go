@@ -0,0 +1,68 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sethvargo/go-retry"
+)
+
+func TestGCSLock_Stats(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ttl := 5 * time.Minute
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	if err := lock.Acquire(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Acquire(ctx, ttl); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := lock.Renew(ctx, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	if err := lock.retry(ctx, func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return retry.RetryableError(fmt.Errorf("attempt %d failed", calls))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := lock.Stats(), (Stats{
+		Acquires:       1,
+		HeldRejections: 1,
+		Retries:        2,
+		Renewals:       1,
+		Releases:       1,
+	}); got != want {
+		t.Errorf("expected %#v to be %#v", got, want)
+	}
+}
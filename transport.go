@@ -0,0 +1,99 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"net/http"
+)
+
+// userAgentTransport is an [http.RoundTripper] that prepends a user agent to
+// every request.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+// RoundTrip implements [http.RoundTripper].
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ua := t.userAgent
+	if existing := req.Header.Get("User-Agent"); existing != "" {
+		ua += " " + existing
+	}
+
+	// RoundTrippers must not modify the original request.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", ua)
+	return t.base.RoundTrip(req)
+}
+
+// withUserAgent returns a shallow copy of the client whose transport prepends
+// the given user agent to every request.
+func withUserAgent(client *http.Client, userAgent string) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	clone := *client
+	clone.Transport = &userAgentTransport{
+		base:      base,
+		userAgent: userAgent,
+	}
+	return &clone
+}
+
+// idempotencyTokenContextKey is the context key for the idempotency token of a
+// write.
+type idempotencyTokenContextKey struct{}
+
+// withIdempotencyTokenContext returns a context that carries the idempotency
+// token for requests made with it.
+func withIdempotencyTokenContext(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, idempotencyTokenContextKey{}, token)
+}
+
+// idempotencyTransport is an [http.RoundTripper] that sets the idempotency
+// token from the request context, if any. The storage client sets its own token
+// on every request, so it can only be replaced on the transport.
+type idempotencyTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements [http.RoundTripper].
+func (t *idempotencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, ok := req.Context().Value(idempotencyTokenContextKey{}).(string)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the original request.
+	req = req.Clone(req.Context())
+	req.Header.Set(idempotencyTokenHeader, token)
+	return t.base.RoundTrip(req)
+}
+
+// withIdempotencyToken returns a shallow copy of the client whose transport
+// sets the idempotency token from the request context.
+func withIdempotencyToken(client *http.Client) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	clone := *client
+	clone.Transport = &idempotencyTransport{base: base}
+	return &clone
+}
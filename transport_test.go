@@ -0,0 +1,89 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+type headerTransport struct {
+	key, value string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(t.key, t.value)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var headers http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = r.Header.Clone()
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"code":404,"message":"not found"}}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	httpClient := &http.Client{Transport: &headerTransport{key: "X-Proxy", value: "corp"}}
+	lock, err := NewWithOptions(ctx, "my-bucket", "my-object",
+		WithHTTPClient(httpClient),
+		WithUserAgentSuffix("myservice/2.3.1"),
+		WithClientOptions(option.WithEndpoint(srv.URL+"/storage/v1/")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := lock.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if _, err := lock.Held(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if got, want := headers.Get("X-Proxy"), "corp"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := headers.Get("User-Agent"), userAgent+" myservice/2.3.1"; !strings.HasPrefix(got, want) {
+		t.Errorf("expected %q to start with %q", got, want)
+	}
+
+	// The caller's client is not modified.
+	if _, ok := httpClient.Transport.(*headerTransport); !ok {
+		t.Errorf("expected transport to be unchanged, got %T", httpClient.Transport)
+	}
+}
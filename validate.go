@@ -0,0 +1,124 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"unicode/utf8"
+)
+
+// validateBucketName checks that the name follows the Google Cloud Storage
+// bucket naming rules.
+//
+// https://cloud.google.com/storage/docs/buckets#naming
+func validateBucketName(name string) error {
+	if name == "" {
+		return fmt.Errorf("bucket name cannot be empty")
+	}
+
+	maxLen := 63
+	if strings.Contains(name, ".") {
+		maxLen = 222
+	}
+	if len(name) < 3 || len(name) > maxLen {
+		return fmt.Errorf("bucket name %q must be between 3 and %d characters", name, maxLen)
+	}
+
+	for _, r := range name {
+		if !isLowerAlphaNum(r) && r != '-' && r != '_' && r != '.' {
+			return fmt.Errorf("bucket name %q contains invalid character %q", name, r)
+		}
+	}
+
+	if !isLowerAlphaNum(rune(name[0])) || !isLowerAlphaNum(rune(name[len(name)-1])) {
+		return fmt.Errorf("bucket name %q must start and end with a letter or number", name)
+	}
+
+	for _, part := range strings.Split(name, ".") {
+		if len(part) > 63 {
+			return fmt.Errorf("bucket name %q has a dot-separated component longer than 63 characters", name)
+		}
+	}
+
+	if net.ParseIP(name) != nil {
+		return fmt.Errorf("bucket name %q cannot be an IP address", name)
+	}
+
+	if strings.HasPrefix(name, "goog") {
+		return fmt.Errorf("bucket name %q cannot begin with \"goog\"", name)
+	}
+
+	return nil
+}
+
+// validateObjectName checks that the name follows the Google Cloud Storage
+// object naming rules. Leading and trailing slashes are also rejected, since
+// they almost always indicate a mistake when joining paths.
+//
+// https://cloud.google.com/storage/docs/objects#naming
+func validateObjectName(name string) error {
+	if name == "" {
+		return fmt.Errorf("object name cannot be empty")
+	}
+
+	if len(name) > 1024 {
+		return fmt.Errorf("object name %q must be at most 1024 bytes", name)
+	}
+
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("object name %q must be valid UTF-8", name)
+	}
+
+	if strings.ContainsAny(name, "\r\n") {
+		return fmt.Errorf("object name %q cannot contain carriage returns or line feeds", name)
+	}
+
+	if name == "." || name == ".." {
+		return fmt.Errorf("object name %q is reserved", name)
+	}
+
+	if strings.HasPrefix(name, ".well-known/acme-challenge/") {
+		return fmt.Errorf("object name %q cannot begin with \".well-known/acme-challenge/\"", name)
+	}
+
+	if strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return fmt.Errorf("object name %q cannot begin or end with a slash", name)
+	}
+
+	return nil
+}
+
+// validateUserAgentSuffix checks that the suffix can be safely appended to the
+// User-Agent header. Only visible ASCII characters and spaces are allowed.
+func validateUserAgentSuffix(suffix string) error {
+	if strings.TrimSpace(suffix) == "" {
+		return fmt.Errorf("user agent suffix cannot be empty")
+	}
+
+	for _, r := range suffix {
+		if r < ' ' || r > '~' {
+			return fmt.Errorf("user agent suffix %q contains invalid character %q", suffix, r)
+		}
+	}
+	return nil
+}
+
+// isLowerAlphaNum returns true if the rune is a lowercase ASCII letter or a
+// digit.
+func isLowerAlphaNum(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')
+}
@@ -0,0 +1,216 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateBucketName(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		bucket string
+		err    string
+	}{
+		{
+			name:   "valid",
+			bucket: "my-bucket_1",
+		},
+		{
+			name:   "valid_dots",
+			bucket: "my.bucket.example.com",
+		},
+		{
+			name:   "empty",
+			bucket: "",
+			err:    "cannot be empty",
+		},
+		{
+			name:   "too_short",
+			bucket: "ab",
+			err:    "must be between 3 and 63 characters",
+		},
+		{
+			name:   "too_long",
+			bucket: strings.Repeat("a", 64),
+			err:    "must be between 3 and 63 characters",
+		},
+		{
+			name:   "uppercase",
+			bucket: "My-Bucket",
+			err:    `contains invalid character 'M'`,
+		},
+		{
+			name:   "slash",
+			bucket: "my/bucket",
+			err:    `contains invalid character '/'`,
+		},
+		{
+			name:   "leading_dash",
+			bucket: "-bucket",
+			err:    "must start and end with a letter or number",
+		},
+		{
+			name:   "long_component",
+			bucket: strings.Repeat("a", 64) + ".com",
+			err:    "longer than 63 characters",
+		},
+		{
+			name:   "ip",
+			bucket: "192.168.5.4",
+			err:    "cannot be an IP address",
+		},
+		{
+			name:   "goog",
+			bucket: "google-bucket",
+			err:    `cannot begin with "goog"`,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			checkErr(t, validateBucketName(tc.bucket), tc.err)
+		})
+	}
+}
+
+func TestValidateObjectName(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		object string
+		err    string
+	}{
+		{
+			name:   "valid",
+			object: "locks/my-object",
+		},
+		{
+			name:   "empty",
+			object: "",
+			err:    "cannot be empty",
+		},
+		{
+			name:   "too_long",
+			object: strings.Repeat("a", 1025),
+			err:    "must be at most 1024 bytes",
+		},
+		{
+			name:   "invalid_utf8",
+			object: "\xff",
+			err:    "must be valid UTF-8",
+		},
+		{
+			name:   "newline",
+			object: "my\nobject",
+			err:    "cannot contain carriage returns or line feeds",
+		},
+		{
+			name:   "dot",
+			object: ".",
+			err:    "is reserved",
+		},
+		{
+			name:   "acme",
+			object: ".well-known/acme-challenge/foo",
+			err:    "cannot begin with",
+		},
+		{
+			name:   "leading_slash",
+			object: "/my-object",
+			err:    "cannot begin or end with a slash",
+		},
+		{
+			name:   "trailing_slash",
+			object: "my-object/",
+			err:    "cannot begin or end with a slash",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			checkErr(t, validateObjectName(tc.object), tc.err)
+		})
+	}
+}
+
+func TestValidateUserAgentSuffix(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		suffix string
+		err    string
+	}{
+		{
+			name:   "valid",
+			suffix: "myservice/2.3.1 (prod)",
+		},
+		{
+			name:   "empty",
+			suffix: " ",
+			err:    "cannot be empty",
+		},
+		{
+			name:   "newline",
+			suffix: "myservice/2.3.1\r\nX-Injected: true",
+			err:    "contains invalid character",
+		},
+		{
+			name:   "non_ascii",
+			suffix: "myservice/\u00e9",
+			err:    "contains invalid character",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			checkErr(t, validateUserAgentSuffix(tc.suffix), tc.err)
+		})
+	}
+}
+
+// checkErr asserts that err contains the expected message, or is nil when the
+// message is empty.
+func checkErr(tb testing.TB, err error, exp string) {
+	tb.Helper()
+
+	if err != nil {
+		if exp == "" {
+			tb.Fatal(err)
+		}
+		if got, want := err.Error(), exp; !strings.Contains(got, want) {
+			tb.Errorf("expected %q to contain %q", got, want)
+		}
+	} else if exp != "" {
+		tb.Fatalf("expected error %q, got nothing", exp)
+	}
+}
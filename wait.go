@@ -0,0 +1,178 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sethvargo/go-retry"
+)
+
+// AcquireWait is like [Lock.Acquire], but blocks until the lock is acquired or
+// the context is done.
+//
+// While the lock is held by another process, it waits until the current lease
+// expires and then tries again. Use [WithContentionPolicy] or
+// [WithContentionBackoff] to control how long to wait between attempts
+// instead.
+//
+// Errors other than [*LockHeldError] are returned immediately.
+func (l *Lock) AcquireWait(ctx context.Context, ttl time.Duration) error {
+	ctx = l.resolveContext(ctx)
+
+	var policy retry.Backoff
+	switch {
+	case l.contentionPolicy != nil:
+		policy = l.contentionPolicy()
+	case l.contentionBackoff != nil:
+		policy = l.contentionBackoff()
+	}
+
+	for {
+		err := l.Acquire(ctx, ttl)
+
+		var lockErr *LockHeldError
+		if !errors.As(err, &lockErr) {
+			return err
+		}
+
+		// The lock is held through the end of the not-before second.
+		expiry := lockErr.NotBefore().Add(time.Second).Sub(l.now())
+
+		var wait time.Duration
+		if policy != nil {
+			next, stop := policy.Next()
+			if stop {
+				return err
+			}
+			wait = next
+
+			// Never sleep past the current lease.
+			if l.contentionBackoff != nil && expiry < wait {
+				wait = expiry
+			}
+		} else {
+			wait = expiry
+		}
+
+		if err := sleep(ctx, wait); err != nil {
+			return l.acquireError(err)
+		}
+	}
+}
+
+// WaitUntilAvailable blocks until the lock is not held by anyone, without
+// acquiring it. This is useful when a different component is responsible for
+// acquiring the lock.
+//
+// While the lock is held, it waits until the current lease expires, checking
+// again at least every poll interval so that an early release is noticed. A
+// poll interval of zero only checks when the lease expires.
+//
+// It returns nil once the lock is missing or expired, or the context error if
+// the context is done first.
+func (l *Lock) WaitUntilAvailable(ctx context.Context, poll time.Duration) error {
+	ctx = l.resolveContext(ctx)
+
+	for {
+		info, err := l.Info(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for lock: %w", err)
+		}
+
+		now := l.now()
+		if !info.HeldAt(now) {
+			return nil
+		}
+
+		// The lock is held through the end of the not-before second.
+		wait := info.NotBefore.Add(time.Second).Sub(now)
+		if poll > 0 && poll < wait {
+			wait = poll
+		}
+
+		if err := sleep(ctx, wait); err != nil {
+			return fmt.Errorf("failed to wait for lock: %w", err)
+		}
+	}
+}
+
+// WatchGeneration blocks until the generation of the lock object differs from
+// fromGen, checking every poll interval, and returns the new generation. The
+// generation changes whenever any process acquires, renews, or releases the
+// lock, so this is useful for reacting to leadership transitions without
+// acquiring the lock. A generation of zero means the lock object does not
+// exist. It always reads the object, even if [WithStateCache] is configured.
+//
+// It returns the context error if the context is done first.
+func (l *Lock) WatchGeneration(ctx context.Context, fromGen int64, poll time.Duration) (int64, error) {
+	ctx = l.resolveContext(ctx)
+
+	if poll <= 0 {
+		return 0, fmt.Errorf("failed to watch lock: poll interval %s must be positive", poll)
+	}
+
+	for {
+		info, err := l.readInfo(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to watch lock: %w", err)
+		}
+
+		if info.Generation != fromGen {
+			return info.Generation, nil
+		}
+
+		if err := sleep(ctx, poll); err != nil {
+			return 0, fmt.Errorf("failed to watch lock: %w", err)
+		}
+	}
+}
+
+// ExpiryNotify returns a channel that receives a value lead before the lease
+// most recently acquired or renewed by this process expires, so callers can
+// renew proactively without polling. The time is computed once, from the
+// expiration recorded by our last write and the lock's clock, so call it again
+// after renewing. If this process does not hold a lease, or it is already
+// within lead of expiring, the channel receives immediately. If ctx is done
+// first, the channel never receives.
+func (l *Lock) ExpiryNotify(ctx context.Context, lead time.Duration) <-chan struct{} {
+	ctx = l.resolveContext(ctx)
+
+	ch := make(chan struct{}, 1)
+
+	var wait time.Duration
+	if nbf := l.lastNotBefore(); !nbf.IsZero() {
+		wait = nbf.Add(-lead).Sub(l.now())
+	}
+	if wait <= 0 {
+		ch <- struct{}{}
+		return ch
+	}
+
+	go func() {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+			ch <- struct{}{}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,276 @@
+// Copyright 2023 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcslock
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/sethvargo/go-retry"
+	"google.golang.org/api/option"
+)
+
+func TestGCSLock_AcquireWait(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	writeTestLock(t, gcsServer, time.Now().Add(time.Second))
+	lock := newTestLock(t, gcsServer)
+
+	if err := lock.AcquireWait(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	held, err := lock.Held(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !held {
+		t.Errorf("expected lock to be held")
+	}
+}
+
+func TestGCSLock_AcquireWait_contentionPolicy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	writeTestLock(t, gcsServer, time.Now().Add(5*time.Minute))
+	lock := newTestLock(t, gcsServer,
+		WithContentionPolicy(func() retry.Backoff {
+			return retry.WithMaxRetries(2, retry.NewConstant(10*time.Millisecond))
+		}))
+
+	// Each wait gets a fresh policy, so both make three attempts.
+	for i := 0; i < 2; i++ {
+		err := lock.AcquireWait(ctx, 5*time.Minute)
+
+		var lockErr *LockHeldError
+		if !errors.As(err, &lockErr) {
+			t.Fatalf("expected %s (%T) to be %T", err, err, lockErr)
+		}
+	}
+	if got, want := lock.Stats().HeldRejections, int64(6); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	_, err := NewWithOptions(ctx, "my-bucket", "my-object", WithContentionPolicy(nil))
+	checkErr(t, err, "cannot be nil")
+}
+
+func TestGCSLock_AcquireWait_contextCancelled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	t.Cleanup(cancel)
+
+	gcsServer := newTestServer(t)
+	writeTestLock(t, gcsServer, time.Now().Add(5*time.Minute))
+	lock := newTestLock(t, gcsServer)
+
+	if err := lock.AcquireWait(ctx, 5*time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v to be %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestGCSLock_WaitUntilAvailable(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	writeTestLock(t, gcsServer, time.Now().Add(5*time.Minute))
+	lock := newTestLock(t, gcsServer)
+
+	// Release the lock early; the poll interval should notice.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := gcsServer.Client().Bucket("my-bucket").Object("my-object").Delete(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if err := lock.WaitUntilAvailable(ctx, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	held, err := lock.Held(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held {
+		t.Errorf("expected lock to not be held")
+	}
+}
+
+func TestGCSLock_WaitUntilAvailable_contextCancelled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	t.Cleanup(cancel)
+
+	gcsServer := newTestServer(t)
+	writeTestLock(t, gcsServer, time.Now().Add(5*time.Minute))
+	lock := newTestLock(t, gcsServer)
+
+	if err := lock.WaitUntilAvailable(ctx, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v to be %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestGCSLock_WatchGeneration(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	writeTestLock(t, gcsServer, time.Now().Add(5*time.Minute))
+	generation := objectGeneration(t, gcsServer)
+	lock := newTestLock(t, gcsServer)
+
+	// Another process renews the lock.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		w := gcsServer.Client().Bucket("my-bucket").Object("my-object").NewWriter(ctx)
+		w.Metadata = map[string]string{
+			notBeforeKey: strconv.FormatInt(time.Now().Add(10*time.Minute).Unix(), 10),
+		}
+		if err := w.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	got, err := lock.WatchGeneration(ctx, generation, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == generation {
+		t.Errorf("expected generation %d to change", got)
+	}
+	if want := objectGeneration(t, gcsServer); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestGCSLock_WatchGeneration_contextCancelled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	t.Cleanup(cancel)
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	if _, err := lock.WatchGeneration(ctx, 0, 20*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v to be %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestGCSLock_ExpiryNotify(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	lock := newTestLock(t, gcsServer)
+
+	// Without a lease, the channel fires immediately.
+	select {
+	case <-lock.ExpiryNotify(ctx, time.Second):
+	default:
+		t.Fatal("expected notification without a lease")
+	}
+
+	nbf, err := lock.AcquireLease(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend most of the lease has elapsed.
+	now := nbf.Add(-time.Minute - 50*time.Millisecond)
+	lock.nowFunc = func() time.Time { return now }
+
+	select {
+	case <-lock.ExpiryNotify(ctx, time.Minute):
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected notification")
+	}
+
+	// Cancelling the context stops the notification.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	ch := lock.ExpiryNotify(cancelCtx, time.Second)
+	cancel()
+	select {
+	case <-ch:
+		t.Fatal("expected no notification")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestGCSLock_AcquireWait_contentionBackoff(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	gcsServer := newTestServer(t)
+	writeTestLock(t, gcsServer, time.Now().Add(5*time.Minute))
+
+	transport := &countingTransport{base: gcsServer.HTTPClient().Transport}
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := newTestLock(t, gcsServer,
+		WithRetryJitterPercent(0),
+		WithContentionBackoff(10*time.Millisecond, 80*time.Millisecond))
+	lock.client = client
+
+	// Waits of 10, 20, 40, 80, 80... fit about 6 reads in 300ms, where a
+	// constant 10ms would take about 30.
+	waitCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	if err := lock.AcquireWait(waitCtx, time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v to be %v", err, context.DeadlineExceeded)
+	}
+	if got := transport.count.Load(); got > 10 {
+		t.Errorf("expected %d reads to be at most 10", got)
+	}
+
+	// The backoff never sleeps past the lease, so an expiring lock is acquired
+	// promptly.
+	writeTestLock(t, gcsServer, time.Now())
+	lock = newTestLock(t, gcsServer, WithContentionBackoff(time.Minute, time.Hour))
+	waitCtx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := lock.AcquireWait(waitCtx, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithContentionBackoff(t *testing.T) {
+	t.Parallel()
+
+	checkErr(t, WithContentionBackoff(0, time.Second)(new(Lock)), "must be positive")
+	checkErr(t, WithContentionBackoff(time.Second, time.Millisecond)(new(Lock)), "must be at least base")
+}